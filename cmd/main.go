@@ -3,62 +3,155 @@ package main
 import (
 	"app/config"
 	"app/internal/handlers"
+	"app/internal/logging"
+	"app/internal/metrics"
 	"app/internal/repositories"
 	"app/internal/services"
+	"app/internal/tracing"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
+	"os"
 	"os/signal"
 	"syscall"
-	"time"
 )
 
 func main() {
 
 	cfg := config.LoadConfig()
+	if err := logging.Setup(cfg.Logging.Format, cfg.Logging.Level); err != nil {
+		fatal("logging config error", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing.Exporter, cfg.Tracing.File)
+	if err != nil {
+		fatal("tracing config error", err)
+	}
 	
-	paymentRepo := repositories.NewSeagm(cfg.PaymentConfig.Email, cfg.PaymentConfig.Password)
+	browserPool := repositories.NewBrowserPool(cfg.Browser.MaxInstances, cfg.Browser.MaxTabs, cfg.Browser.WarmSpares, cfg.Browser.RecycleAfter)
+	loginStore, err := repositories.NewLoginStore(cfg.LoginStore.Dir, cfg.LoginStore.Secret)
+	if err != nil {
+		fatal("login store error", err)
+	}
+	paymentRegistry := repositories.NewPaymentRegistryFromConfig(cfg.PaymentConfig, browserPool, loginStore)
+	if _, err := paymentRegistry.Get(paymentRegistry.Default()); err != nil {
+		fatal("payment provider error", err)
+	}
 	pb := repositories.NewPocketBase(cfg.PocketBase.Address, cfg.PocketBase.Email, cfg.PocketBase.Password)
 
-	exportService := services.NewExportService(paymentRepo, pb)
-	verifyRepo := repositories.NewVerifyRepository()
+	lifecycle := services.NewLifecycle()
+	providerSlots := services.NewProviderSlots(paymentRegistry.Names(), cfg.Export.Concurrency, cfg.Export.ProviderConcurrency)
+	exportService := services.NewExportService(paymentRegistry, pb, cfg.PaymentConfig.Locale, cfg.PaymentConfig.TTL, lifecycle, providerSlots)
+	if err := exportService.PublishCapabilities(ctx, "paymentProviders"); err != nil {
+		slog.Error("failed to publish provider capabilities", "error", err)
+	}
+	verifyRepo := repositories.NewVerifyRepository(browserPool)
 	verifyService := services.NewVerifyService(pb, verifyRepo)
+	if err := verifyService.CheckCreditSetup(ctx); err != nil {
+		fatal("PocketBase setup error", err)
+	}
+
+	exportPool := services.NewExportPool(exportService, services.NewPaymentStatusService(pb), cfg.PaymentConfig.Locale, paymentRegistry.Names(), paymentRegistry.Default(), cfg.Export.Concurrency, cfg.Export.ProviderConcurrency, cfg.Export.QueueSize, providerSlots)
+	exportPool.Start(lifecycle.Context())
+	go browserPool.Start(lifecycle.Context())
 
-	exportHandler := handlers.NewExportHandler(exportService)
-	schedulerHandler := handlers.NewSchedulerHandler(verifyService)
+	exportHandler := handlers.NewExportHandler(exportService, exportPool)
+	schedulerHandler := handlers.NewSchedulerHandler(verifyService, exportService, exportPool, lifecycle)
 	schedulerHandler.StartVerifyPayment("payment")
+	if err := schedulerHandler.StartExpirePayment("payment", cfg.PaymentConfig.ExpirySchedule, cfg.PaymentConfig.TTL); err != nil {
+		fatal("expiry schedule error", err)
+	}
+	if err := schedulerHandler.StartRecoverPayment(lifecycle.Context(), "payment", cfg.Recovery.Schedule, cfg.Recovery.StuckAfter, cfg.Recovery.ResumeWithin); err != nil {
+		fatal("recovery schedule error", err)
+	}
 
 	go func() {
-		for {
-			startListenPayment, stopListenPayment, recordChan, errChan := exportHandler.StartListeningOrder("payment")
-			go func() {
-				for {
-					select {
-					case record := <-recordChan:
-						if err := exportHandler.ExportPayment("payment", record); err != nil {
-							log.Println("Error exporting payment:", err)
-						}
-					case err := <-errChan:
-						log.Println("Error listening for payment records:", err)
-						stopListenPayment()
-						return
-					}
-				}
-			}()
-			startListenPayment()
-			log.Println("Started listening for new payment records...")
+		slog.Info("listening for new payment records")
+		if err := exportHandler.ListenOrders(ctx, "payment"); err != nil {
+			slog.Error("failed to listen for payment records", "error", err)
 		}
 	}()
 
-	
+	metrics.RegisterBrowserTabs(repositories.SessionCount)
+	metrics.RegisterBrowserInstances(func() int { return len(browserPool.Stats()) })
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	health := handlers.NewHealthHandler(
+		handlers.HealthCheck{Name: "pocketbase", Check: func() error {
+			if !pb.IsReady() {
+				return errors.New("superuser token is not valid")
+			}
+			return nil
+		}},
+		handlers.HealthCheck{Name: "realtime", Check: func() error {
+			if !exportService.Listening() {
+				return errors.New("realtime subscription is not connected")
+			}
+			return nil
+		}},
+		handlers.HealthCheck{Name: "provider", Check: func() error {
+			if !exportService.ProviderLoginState()[paymentRegistry.Default()] {
+				return fmt.Errorf("%s is logged out", paymentRegistry.Default())
+			}
+			return nil
+		}},
+		handlers.HealthCheck{Name: "scheduler", Check: func() error {
+			if !schedulerHandler.Running() {
+				return errors.New("scheduler is stopped")
+			}
+			return nil
+		}},
+		handlers.HealthCheck{Name: "lifecycle", Check: func() error {
+			if lifecycle.Draining() {
+				return services.ErrShuttingDown
+			}
+			return nil
+		}},
+	)
+	mux.Handle("GET /healthz", health)
+	mux.Handle("GET /readyz", health)
+	mux.Handle("/admin/", handlers.NewAdminHandler("payment", cfg.Admin.Token, exportService, verifyService, exportPool, lifecycle))
+	server := &http.Server{Addr: cfg.Admin.Address, Handler: mux}
+	go func() {
+		slog.Info("HTTP server listening", "address", cfg.Admin.Address)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to serve HTTP", "error", err)
+		}
+	}()
+
+	lifecycle.OnStopIntake(schedulerHandler.Stop)
+	lifecycle.OnStopIntake(exportPool.Stop)
+	lifecycle.OnInterrupted(services.TaskExport, func(task services.Task) {
+		if err := exportService.MarkInterrupted(context.Background(), task.Collection, task.Id); err != nil {
+			slog.Error("failed to mark payment interrupted", logging.KeyPaymentId, task.Id, "error", err)
+		}
+	})
+	lifecycle.OnClose(paymentRegistry.Close)
+	lifecycle.OnClose(browserPool.Close)
+	lifecycle.OnClose(pb.Close)
+	lifecycle.OnClose(func() {
+		if err := server.Close(); err != nil {
+			slog.Error("failed to close HTTP server", "error", err)
+		}
+	})
+	lifecycle.OnClose(func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("failed to flush traces", "error", err)
+		}
+	})
 
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
 	<-ctx.Done()
-	fmt.Println("Shutting down gracefully, press Ctrl+C again to force")
-	pb.Close()
-	paymentRepo.Close()
-	schedulerHandler.Stop()
-	time.Sleep(7 * time.Second)
-	fmt.Println("Server exiting")
+	stop()
+	slog.Info("shutting down gracefully, press Ctrl+C again to force")
+	lifecycle.Shutdown(cfg.Lifecycle.ShutdownTimeout)
+	slog.Info("server exiting")
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
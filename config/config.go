@@ -1,7 +1,9 @@
 package config
 
 import (
-	"log"
+	"log/slog"
+	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
@@ -11,6 +13,14 @@ type Config struct {
 	PocketBase    PocketBaseConfig
 	Imap          ImapConfig
 	PaymentConfig PaymentConfig
+	Recovery      RecoveryConfig
+	Export        ExportConfig
+	Lifecycle     LifecycleConfig
+	Admin         AdminConfig
+	Logging       LoggingConfig
+	Tracing       TracingConfig
+	Browser       BrowserConfig
+	LoginStore    LoginStoreConfig
 }
 
 type PocketBaseConfig struct {
@@ -28,8 +38,90 @@ type ImapConfig struct {
 }
 
 type PaymentConfig struct {
-	Email    string `envconfig:"PAYMENT_EMAIL"`
-	Password string `envconfig:"PAYMENT_PASSWORD"`
+	Provider       string        `envconfig:"PAYMENT_PROVIDER" default:"seagm"`
+	Failover       []string      `envconfig:"PAYMENT_FAILOVER"`
+	Locale         string        `envconfig:"PAYMENT_MESSAGE_LOCALE" default:"th"`
+	TTL            time.Duration `envconfig:"PAYMENT_TTL" default:"15m"`
+	ExpirySchedule string        `envconfig:"PAYMENT_EXPIRY_SCHEDULE" default:"@every 1m"`
+	Seagm          SeagmConfig
+	LapakGaming    LapakGamingConfig
+	Ggkeystore     GgkeystoreConfig
+	// LegacyEmail and LegacyPassword are the SEAGM credentials from before
+	// providers had their own settings; SEAGM_EMAIL and SEAGM_PASSWORD win.
+	LegacyEmail    string `envconfig:"PAYMENT_EMAIL"`
+	LegacyPassword string `envconfig:"PAYMENT_PASSWORD"`
+}
+
+type SeagmConfig struct {
+	Email    string `envconfig:"SEAGM_EMAIL"`
+	Password string `envconfig:"SEAGM_PASSWORD"`
+}
+
+type LapakGamingConfig struct {
+	Email string `envconfig:"LAPAKGAMING_EMAIL"`
+}
+
+type GgkeystoreConfig struct {
+	Email    string `envconfig:"GGKEYSTORE_EMAIL"`
+	Password string `envconfig:"GGKEYSTORE_PASSWORD"`
+}
+
+type RecoveryConfig struct {
+	Schedule     string        `envconfig:"RECOVERY_SCHEDULE" default:"@every 5m"`
+	StuckAfter   time.Duration `envconfig:"RECOVERY_STUCK_AFTER" default:"10m"`
+	ResumeWithin time.Duration `envconfig:"RECOVERY_RESUME_WITHIN" default:"30m"`
+}
+
+// ExportConfig bounds how many payments are exported at once. Each provider
+// runs Concurrency workers unless ProviderConcurrency overrides it, e.g.
+// EXPORT_PROVIDER_CONCURRENCY=seagm:3,lapakgaming:1.
+type ExportConfig struct {
+	Concurrency         int            `envconfig:"EXPORT_CONCURRENCY" default:"2"`
+	ProviderConcurrency map[string]int `envconfig:"EXPORT_PROVIDER_CONCURRENCY"`
+	QueueSize           int            `envconfig:"EXPORT_QUEUE_SIZE" default:"50"`
+}
+
+type LifecycleConfig struct {
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+}
+
+// AdminConfig configures the embedded HTTP server. The admin API refuses
+// every request while Token is empty.
+type AdminConfig struct {
+	Address string `envconfig:"ADMIN_ADDRESS" default:":8080"`
+	Token   string `envconfig:"ADMIN_TOKEN"`
+}
+
+type LoggingConfig struct {
+	Format string `envconfig:"LOG_FORMAT" default:"text"`
+	Level  string `envconfig:"LOG_LEVEL" default:"info"`
+}
+
+// TracingConfig selects the span exporter: none, stdout, file (written to
+// File) or otlp, which is configured by the standard OTEL_EXPORTER_OTLP_*
+// variables. Left empty, otlp is used when an OTLP endpoint is set.
+type TracingConfig struct {
+	Exporter string `envconfig:"TRACE_EXPORTER"`
+	File     string `envconfig:"TRACE_FILE" default:"traces.jsonl"`
+}
+
+// BrowserConfig sizes the Chrome pool shared by the providers. WarmSpares
+// idle instances of every browser profile are kept started, and instances
+// are replaced once they are older than RecycleAfter; zero disables
+// recycling.
+type BrowserConfig struct {
+	MaxInstances int           `envconfig:"BROWSER_MAX_INSTANCES" default:"6"`
+	MaxTabs      int           `envconfig:"BROWSER_MAX_TABS" default:"5"`
+	WarmSpares   int           `envconfig:"BROWSER_WARM_SPARES" default:"1"`
+	RecycleAfter time.Duration `envconfig:"BROWSER_RECYCLE_AFTER" default:"6h"`
+}
+
+// LoginStoreConfig keeps provider logins across restarts: cookies and local
+// storage are encrypted with a key derived from Secret and written to Dir.
+// An empty Secret disables it and every start logs in again.
+type LoginStoreConfig struct {
+	Dir    string `envconfig:"LOGIN_STORE_DIR" default:"sessions"`
+	Secret string `envconfig:"LOGIN_STORE_SECRET"`
 }
 
 func LoadConfig() Config {
@@ -39,7 +131,13 @@ func LoadConfig() Config {
 		_ = godotenv.Load("../.env") // Try loading from parent directory
 	}
 	if err := envconfig.Process("", &cfg); err != nil {
-		log.Fatalf("read env error : %s", err.Error())
+		slog.Error("read env error", "error", err)
+		os.Exit(1)
+	}
+	if seagm := &cfg.PaymentConfig.Seagm; seagm.Email == "" && cfg.PaymentConfig.LegacyEmail != "" {
+		slog.Warn("PAYMENT_EMAIL and PAYMENT_PASSWORD are deprecated, use SEAGM_EMAIL and SEAGM_PASSWORD")
+		seagm.Email = cfg.PaymentConfig.LegacyEmail
+		seagm.Password = cfg.PaymentConfig.LegacyPassword
 	}
 	return cfg
 }
@@ -0,0 +1,110 @@
+package domains
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrInvalidAmount     = errors.New("amount not acceptable")
+	ErrUnsupportedMethod = errors.New("payment method not acceptable")
+	ErrProviderLoggedOut = errors.New("provider session is logged out")
+	ErrSelectorNotFound  = errors.New("page element not found")
+	ErrQrNotDecodable    = errors.New("QR code could not be decoded")
+	ErrTimeout           = errors.New("provider timed out")
+	ErrBrowserClosed     = errors.New("browser tab closed")
+	ErrProviderPaused    = errors.New("provider is paused")
+	ErrBusy              = errors.New("export queue is full")
+	// ErrOrderPlaced wraps failures after a provider created the order, so
+	// the export does not fail over and place a second one.
+	ErrOrderPlaced = errors.New("provider order was already placed")
+)
+
+type ErrorKind int
+
+const (
+	// Retryable failures are specific to one provider; the next one may succeed.
+	Retryable ErrorKind = iota
+	// UserFacing failures come from the request itself and are reported as is.
+	UserFacing
+	// Fatal failures stop the export altogether, e.g. on shutdown.
+	Fatal
+)
+
+type errorPolicy struct {
+	err      error
+	kind     ErrorKind
+	messages map[string]string
+}
+
+const DefaultLocale = "th"
+
+var unavailableMessages = map[string]string{
+	"en": "The payment system is temporarily unavailable, please try again later.",
+	"th": "ระบบชำระเงินขัดข้องชั่วคราว กรุณาลองใหม่อีกครั้งภายหลัง",
+}
+
+// errorPolicies are matched in order, so wrappers such as ErrOrderPlaced
+// come before the errors they wrap.
+var errorPolicies = []errorPolicy{
+	{ErrOrderPlaced, Fatal, map[string]string{
+		"en": "The payment could not be completed, please create a new payment.",
+		"th": "ไม่สามารถดำเนินการชำระเงินให้เสร็จสิ้นได้ กรุณาสร้างรายการชำระเงินใหม่",
+	}},
+	{ErrInvalidAmount, UserFacing, map[string]string{
+		"en": "This amount cannot be paid, please choose another amount.",
+		"th": "ไม่สามารถชำระด้วยจำนวนเงินนี้ได้ กรุณาเลือกจำนวนเงินอื่น",
+	}},
+	{ErrUnsupportedMethod, UserFacing, map[string]string{
+		"en": "This payment method is not available.",
+		"th": "ไม่รองรับช่องทางการชำระเงินนี้",
+	}},
+	{ErrProviderLoggedOut, Retryable, unavailableMessages},
+	{ErrSelectorNotFound, Retryable, unavailableMessages},
+	{ErrQrNotDecodable, Retryable, map[string]string{
+		"en": "Could not create a payment QR code, please try again.",
+		"th": "ไม่สามารถสร้าง QR สำหรับชำระเงินได้ กรุณาลองใหม่อีกครั้ง",
+	}},
+	{ErrTimeout, Retryable, map[string]string{
+		"en": "The payment provider took too long to respond, please try again.",
+		"th": "ผู้ให้บริการชำระเงินตอบสนองช้าเกินไป กรุณาลองใหม่อีกครั้ง",
+	}},
+	{ErrBrowserClosed, Retryable, unavailableMessages},
+	{ErrProviderPaused, Retryable, unavailableMessages},
+	{ErrBusy, UserFacing, map[string]string{
+		"en": "The payment system is busy right now, please try again in a few minutes.",
+		"th": "ระบบชำระเงินมีผู้ใช้งานจำนวนมาก กรุณาลองใหม่อีกครั้งในอีกสักครู่",
+	}},
+	{context.Canceled, Fatal, unavailableMessages},
+}
+
+func findPolicy(err error) (errorPolicy, bool) {
+	for _, policy := range errorPolicies {
+		if errors.Is(err, policy.err) {
+			return policy, true
+		}
+	}
+	return errorPolicy{}, false
+}
+
+// ClassifyError returns the kind of a provider error. Errors outside the
+// taxonomy are treated as retryable so another provider still gets a chance.
+func ClassifyError(err error) ErrorKind {
+	if policy, ok := findPolicy(err); ok {
+		return policy.kind
+	}
+	return Retryable
+}
+
+// UserMessage returns the message shown to the customer for err in locale,
+// falling back to DefaultLocale when there is no translation.
+func UserMessage(err error, locale string) string {
+	messages := unavailableMessages
+	if policy, ok := findPolicy(err); ok {
+		messages = policy.messages
+	}
+	if message, ok := messages[locale]; ok {
+		return message
+	}
+	return messages[DefaultLocale]
+}
@@ -0,0 +1,56 @@
+package domains
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorKind
+	}{
+		{"invalid amount", ErrInvalidAmount, UserFacing},
+		{"unsupported method", fmt.Errorf("seagm: %w", ErrUnsupportedMethod), UserFacing},
+		{"busy", ErrBusy, UserFacing},
+		{"logged out", ErrProviderLoggedOut, Retryable},
+		{"selector", fmt.Errorf("%w: waiting for #pay", ErrSelectorNotFound), Retryable},
+		{"timeout", ErrTimeout, Retryable},
+		{"browser closed", ErrBrowserClosed, Retryable},
+		{"paused", ErrProviderPaused, Retryable},
+		{"canceled", context.Canceled, Fatal},
+		{"order placed", fmt.Errorf("%w: %w", ErrOrderPlaced, ErrSelectorNotFound), Fatal},
+		{"unknown", errors.New("net/http: connection reset"), Retryable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("ClassifyError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		locale string
+		want   string
+	}{
+		{"english", ErrInvalidAmount, "en", "This amount cannot be paid, please choose another amount."},
+		{"default locale", ErrInvalidAmount, "de", "ไม่สามารถชำระด้วยจำนวนเงินนี้ได้ กรุณาเลือกจำนวนเงินอื่น"},
+		{"wrapper wins", fmt.Errorf("%w: %w", ErrOrderPlaced, ErrTimeout), "en", "The payment could not be completed, please create a new payment."},
+		{"unknown", errors.New("boom"), "en", unavailableMessages["en"]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := UserMessage(tt.err, tt.locale); got != tt.want {
+				t.Errorf("UserMessage(%v, %q) = %q, want %q", tt.err, tt.locale, got, tt.want)
+			}
+		})
+	}
+}
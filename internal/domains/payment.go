@@ -1,5 +1,11 @@
 package domains
 
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
 type PaymentMethod string
 
 const (
@@ -9,3 +15,28 @@ const (
 	TrueMoneyCode PaymentMethod = "truemoneycode"
 	RazorGoldPin  PaymentMethod = "razorgoldpin"
 )
+
+type PaymentAttempt struct {
+	Provider PaymentProvider `json:"provider"`
+	OrderId  string          `json:"orderId"`
+	Error    string          `json:"error"`
+	Created  string          `json:"created"`
+	// Superseded attempts belong to an export an operator started over.
+	Superseded bool `json:"superseded,omitempty"`
+}
+
+type PaymentRequest struct {
+	Id     string
+	Method PaymentMethod
+	Phone  string
+	Amount decimal.Decimal
+}
+
+type PaymentResult struct {
+	RedirectUrl string
+	QrData      string
+	OrderId     string
+	Message     string
+	ExpiresAt   time.Time
+	Screenshots [][]byte
+}
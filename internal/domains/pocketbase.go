@@ -1,6 +1,10 @@
 package domains
 
-import "github.com/shopspring/decimal"
+import (
+	"log/slog"
+
+	"github.com/shopspring/decimal"
+)
 
 type AuthResponse struct {
 	Token  string          `json:"token"`
@@ -25,13 +29,59 @@ type ListRecordsResponse[T any] struct {
 }
 
 type PaymentRecord struct {
+	Id          string `json:"id"`
+	UserId      string `json:"userId"`
+	PaymentType string `json:"paymentType"`
+	Provider    string `json:"provider"`
+	// UsedProvider is the provider the last attempt went to; Provider stays
+	// the one the payment asked for.
+	UsedProvider string           `json:"usedProvider"`
+	Amount       decimal.Decimal  `json:"amount"`
+	PhoneNumber  string           `json:"phoneNumber"`
+	Status       PaymentStatus    `json:"status"`
+	PaymentUrl   string           `json:"paymentUrl"`
+	Attempts     []PaymentAttempt `json:"attempts"`
+	Progress     int              `json:"progress"`
+	ExpiresAt    string           `json:"expiresAt"`
+	Created      string           `json:"created"`
+	Updated      string           `json:"updated"`
+}
+
+// LogValue keeps the phone number out of logs when a whole record is logged.
+func (r PaymentRecord) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("id", r.Id),
+		slog.String("userId", r.UserId),
+		slog.String("provider", r.Provider),
+		slog.String("amount", r.Amount.String()),
+		slog.String("status", string(r.Status)),
+		slog.Int("progress", r.Progress),
+	)
+}
+
+type ProviderCapabilitiesRecord struct {
+	Id string `json:"id"`
+	ProviderCapabilities
+}
+
+type CreditTransactionRecord struct {
 	Id          string          `json:"id"`
 	UserId      string          `json:"userId"`
-	PaymentType string          `json:"paymentType"`
+	PaymentId   string          `json:"paymentId"`
 	Amount      decimal.Decimal `json:"amount"`
-	PhoneNumber string          `json:"phoneNumber"`
-	Status      string          `json:"status"`
-	PaymentUrl  string          `json:"paymentUrl"`
+	Description string          `json:"description"`
+	Type        string          `json:"type"`
+}
+
+type BatchRequest struct {
+	Method string         `json:"method"`
+	Url    string         `json:"url"`
+	Body   map[string]any `json:"body,omitempty"`
+}
+
+type BatchResponse struct {
+	Status int `json:"status"`
+	Body   any `json:"body"`
 }
 
 type CreateRecordResponse struct {
@@ -0,0 +1,53 @@
+package domains
+
+import "github.com/shopspring/decimal"
+
+type PaymentProvider string
+
+const (
+	Seagm       PaymentProvider = "seagm"
+	LapakGaming PaymentProvider = "lapakgaming"
+	Ggkeystore  PaymentProvider = "ggkeystore"
+)
+
+// ProviderCapabilities describes what a provider can take. A zero MinAmount
+// or MaxAmount leaves that side unbounded; a non-empty Denominations list only
+// allows those exact amounts.
+type ProviderCapabilities struct {
+	Provider      PaymentProvider   `json:"provider"`
+	Methods       []PaymentMethod   `json:"methods"`
+	MinAmount     decimal.Decimal   `json:"minAmount"`
+	MaxAmount     decimal.Decimal   `json:"maxAmount"`
+	Denominations []decimal.Decimal `json:"denominations"`
+	RequiresOtp   bool              `json:"requiresOtp"`
+}
+
+func (c ProviderCapabilities) SupportsMethod(method PaymentMethod) bool {
+	for _, m := range c.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (c ProviderCapabilities) AcceptsAmount(amount decimal.Decimal) bool {
+	if !amount.IsPositive() {
+		return false
+	}
+	if len(c.Denominations) > 0 {
+		for _, v := range c.Denominations {
+			if amount.Equal(v) {
+				return true
+			}
+		}
+		return false
+	}
+	if !c.MinAmount.IsZero() && amount.LessThan(c.MinAmount) {
+		return false
+	}
+	if !c.MaxAmount.IsZero() && amount.GreaterThan(c.MaxAmount) {
+		return false
+	}
+	return true
+}
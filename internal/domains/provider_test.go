@@ -0,0 +1,38 @@
+package domains
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestAcceptsAmount(t *testing.T) {
+	d := decimal.RequireFromString
+	ranged := ProviderCapabilities{MinAmount: d("10"), MaxAmount: d("1000")}
+	denominations := ProviderCapabilities{Denominations: []decimal.Decimal{d("50"), d("100")}}
+	tests := []struct {
+		name   string
+		caps   ProviderCapabilities
+		amount string
+		want   bool
+	}{
+		{"unbounded", ProviderCapabilities{}, "12345.67", true},
+		{"zero", ProviderCapabilities{}, "0", false},
+		{"negative", ProviderCapabilities{}, "-1", false},
+		{"below min", ranged, "9.99", false},
+		{"at min", ranged, "10", true},
+		{"at max", ranged, "1000", true},
+		{"above max", ranged, "1000.01", false},
+		{"min only", ProviderCapabilities{MinAmount: d("10")}, "1000000", true},
+		{"denomination", denominations, "100", true},
+		{"denomination with scale", denominations, "100.00", true},
+		{"not a denomination", denominations, "75", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.caps.AcceptsAmount(d(tt.amount)); got != tt.want {
+				t.Errorf("AcceptsAmount(%s) = %v, want %v", tt.amount, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package domains
+
+import "errors"
+
+type PaymentStatus string
+
+const (
+	StatusPending         PaymentStatus = "pending"
+	StatusSystemPreparing PaymentStatus = "system-preparing"
+	StatusUserPaying      PaymentStatus = "user-paying"
+	StatusSuccess         PaymentStatus = "success"
+	StatusReject          PaymentStatus = "reject"
+	StatusExpired         PaymentStatus = "expired"
+	// StatusBusy is set instead of exporting when the export queue is full.
+	StatusBusy PaymentStatus = "busy"
+)
+
+var (
+	ErrIllegalTransition = errors.New("illegal payment status transition")
+	ErrPaymentFinished   = errors.New("payment is already finished")
+)
+
+// paymentTransitions lists the statuses each status may move to. Finished
+// statuses have no entry, so nothing can move a payment out of them.
+var paymentTransitions = map[PaymentStatus][]PaymentStatus{
+	StatusPending:         {StatusSystemPreparing, StatusReject, StatusBusy},
+	StatusSystemPreparing: {StatusSystemPreparing, StatusUserPaying, StatusReject},
+	StatusUserPaying:      {StatusSuccess, StatusReject, StatusExpired},
+}
+
+// Normalize maps the empty status of a freshly created record to pending.
+func (s PaymentStatus) Normalize() PaymentStatus {
+	if s == "" {
+		return StatusPending
+	}
+	return s
+}
+
+var finalStatuses = map[PaymentStatus]bool{
+	StatusSuccess: true,
+	StatusReject:  true,
+	StatusExpired: true,
+	StatusBusy:    true,
+}
+
+func (s PaymentStatus) IsFinal() bool {
+	return finalStatuses[s]
+}
+
+// CanReopen reports whether an operator may send the payment through export
+// again. Only payments that never reached the customer qualify.
+func (s PaymentStatus) CanReopen() bool {
+	return s == StatusReject || s == StatusBusy
+}
+
+func (s PaymentStatus) CanTransition(to PaymentStatus) bool {
+	for _, next := range paymentTransitions[s.Normalize()] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
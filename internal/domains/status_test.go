@@ -0,0 +1,44 @@
+package domains
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from PaymentStatus
+		to   PaymentStatus
+		want bool
+	}{
+		{"", StatusSystemPreparing, true},
+		{StatusPending, StatusSystemPreparing, true},
+		{StatusPending, StatusReject, true},
+		{StatusPending, StatusBusy, true},
+		{StatusPending, StatusUserPaying, false},
+		{StatusPending, StatusSuccess, false},
+		{StatusSystemPreparing, StatusSystemPreparing, true},
+		{StatusSystemPreparing, StatusUserPaying, true},
+		{StatusSystemPreparing, StatusReject, true},
+		{StatusSystemPreparing, StatusSuccess, false},
+		{StatusSystemPreparing, StatusExpired, false},
+		{StatusUserPaying, StatusSuccess, true},
+		{StatusUserPaying, StatusReject, true},
+		{StatusUserPaying, StatusExpired, true},
+		{StatusUserPaying, StatusPending, false},
+		{StatusSuccess, StatusReject, false},
+		{StatusReject, StatusPending, false},
+		{StatusExpired, StatusSuccess, false},
+		{StatusBusy, StatusSystemPreparing, false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanTransition(tt.to); got != tt.want {
+			t.Errorf("%q -> %q = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestFinalStatusesHaveNoTransitions(t *testing.T) {
+	for status := range finalStatuses {
+		if next := paymentTransitions[status]; len(next) > 0 {
+			t.Errorf("final status %q may move to %v", status, next)
+		}
+	}
+}
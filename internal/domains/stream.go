@@ -2,4 +2,12 @@ package domains
 
 type Listening func() error
 
-type StopListening func()
\ No newline at end of file
+type StopListening func()
+
+type Subscription[T any] struct {
+	Start     Listening
+	Stop      StopListening
+	Records   chan RecordHook[T]
+	Connected chan struct{}
+	Errors    chan error
+}
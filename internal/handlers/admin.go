@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"app/internal/domains"
+	"app/internal/logging"
+	"app/internal/services"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminLoginTimeout bounds a forced provider login started from the API.
+const adminLoginTimeout = 2 * time.Minute
+
+// adminOtpTimeout bounds an OTP submission started from the API.
+const adminOtpTimeout = time.Minute
+
+type adminHandler struct {
+	collection    string
+	token         string
+	exportService services.ExportService
+	verifyService services.VerifyService
+	exportPool    services.ExportPool
+	lifecycle     services.Lifecycle
+	mux           *http.ServeMux
+}
+
+// NewAdminHandler serves the operator API under /admin/. Every request must
+// carry "Authorization: Bearer <token>"; an empty token refuses them all.
+func NewAdminHandler(collection string, token string, exportService services.ExportService, verifyService services.VerifyService, exportPool services.ExportPool, lifecycle services.Lifecycle) http.Handler {
+	h := &adminHandler{
+		collection:    collection,
+		token:         token,
+		exportService: exportService,
+		verifyService: verifyService,
+		exportPool:    exportPool,
+		lifecycle:     lifecycle,
+		mux:           http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /admin/exports", h.listExports)
+	h.mux.HandleFunc("GET /admin/sessions", h.listSessions)
+	h.mux.HandleFunc("DELETE /admin/sessions/{id}", h.closeSession)
+	h.mux.HandleFunc("POST /admin/payments/{id}/verify", h.verifyPayment)
+	h.mux.HandleFunc("POST /admin/payments/{id}/otp", h.submitOtp)
+	h.mux.HandleFunc("POST /admin/payments/{id}/reexport", h.reexportPayment)
+	h.mux.HandleFunc("POST /admin/providers/{provider}/pause", h.pauseProvider)
+	h.mux.HandleFunc("POST /admin/providers/{provider}/resume", h.resumeProvider)
+	h.mux.HandleFunc("POST /admin/providers/{provider}/login", h.loginProvider)
+	return h
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *adminHandler) authorized(r *http.Request) bool {
+	if h.token == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *adminHandler) listExports(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"inFlight":      h.lifecycle.InFlight(),
+		"queueDepth":    h.exportPool.QueueDepth(),
+		"paused":        h.exportPool.Paused(),
+		"sessions":      h.exportService.Sessions(),
+		"sessionCounts": h.exportService.SessionCounts(),
+	})
+}
+
+func (h *adminHandler) listSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.exportService.Sessions())
+}
+
+func (h *adminHandler) closeSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !h.exportService.CloseSession(id) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no browser session for payment %s", id))
+		return
+	}
+	slog.Info("browser session closed by operator", logging.KeyPaymentId, id, logging.KeyStage, "admin")
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "closed": true})
+}
+
+func (h *adminHandler) verifyPayment(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	done, err := h.lifecycle.Begin(services.TaskVerify, h.collection, id)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer done()
+	// A client hanging up must not abort a credit halfway.
+	status, err := h.verifyService.VerifyPayment(context.WithoutCancel(r.Context()), h.collection, id)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "status": status})
+}
+
+func (h *adminHandler) submitOtp(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var body struct {
+		Otp string `json:"otp"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Otp == "" {
+		writeError(w, http.StatusBadRequest, errors.New(`body must be {"otp": "<code>"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), adminOtpTimeout)
+	defer cancel()
+	result, err := h.exportService.SubmitOtp(ctx, id, body.Otp)
+	if errors.Is(err, services.ErrNoSession) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	slog.Info("OTP submitted by operator", logging.KeyPaymentId, id, logging.KeyStage, "admin")
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "message": result.Message})
+}
+
+func (h *adminHandler) reexportPayment(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	record, err := h.exportService.Reopen(context.WithoutCancel(r.Context()), h.collection, id)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err := h.exportPool.Submit(context.WithoutCancel(r.Context()), h.collection, domains.RecordHook[domains.PaymentRecord]{Action: "create", Record: record}); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	logging.Payment(id, record.UserId, record.Provider, "admin").Info("re-export queued by operator")
+	writeJSON(w, http.StatusAccepted, map[string]any{"id": id, "status": domains.StatusPending})
+}
+
+func (h *adminHandler) pauseProvider(w http.ResponseWriter, r *http.Request) {
+	provider := domains.PaymentProvider(r.PathValue("provider"))
+	if err := h.exportPool.Pause(provider); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	slog.Info("provider paused by operator", logging.KeyProvider, provider, logging.KeyStage, "admin")
+	writeJSON(w, http.StatusOK, map[string]any{"paused": h.exportPool.Paused()})
+}
+
+func (h *adminHandler) resumeProvider(w http.ResponseWriter, r *http.Request) {
+	provider := domains.PaymentProvider(r.PathValue("provider"))
+	if err := h.exportPool.Resume(provider); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	slog.Info("provider resumed by operator", logging.KeyProvider, provider, logging.KeyStage, "admin")
+	writeJSON(w, http.StatusOK, map[string]any{"paused": h.exportPool.Paused()})
+}
+
+func (h *adminHandler) loginProvider(w http.ResponseWriter, r *http.Request) {
+	provider := domains.PaymentProvider(r.PathValue("provider"))
+	ctx, cancel := context.WithTimeout(r.Context(), adminLoginTimeout)
+	defer cancel()
+	if err := h.exportService.Login(ctx, provider); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	slog.Info("provider re-login forced by operator", logging.KeyProvider, provider, logging.KeyStage, "admin")
+	writeJSON(w, http.StatusOK, map[string]any{"provider": provider, "loggedIn": true})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Warn("failed to write response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -2,33 +2,50 @@ package handlers
 
 import (
 	"app/internal/domains"
+	"app/internal/logging"
 	"app/internal/services"
+	"context"
 )
 
 type ExportHandler interface {
-	StartListeningOrder(collection string) (domains.Listening, domains.StopListening, chan domains.RecordHook[domains.PaymentRecord], chan error)
-	ExportPayment(collection string, record domains.RecordHook[domains.PaymentRecord]) error
+	ListenOrders(ctx context.Context, collection string) error
+	ExportPayment(ctx context.Context, collection string, record domains.RecordHook[domains.PaymentRecord]) error
+	QueueDepth() map[domains.PaymentProvider]int
 }
 
 type exportHandler struct {
 	ExportService services.ExportService
+	ExportPool    services.ExportPool
 }
 
-func NewExportHandler(exportService services.ExportService) ExportHandler {
+func NewExportHandler(exportService services.ExportService, exportPool services.ExportPool) ExportHandler {
 	return &exportHandler{
 		ExportService: exportService,
+		ExportPool:    exportPool,
 	}
 }
 
-func (h *exportHandler) StartListeningOrder(collection string) (domains.Listening, domains.StopListening, chan domains.RecordHook[domains.PaymentRecord], chan error) {
-	Start, Stop, RecordChan, ErrChan := h.ExportService.ListeningOrder(collection)
-	return Start, Stop, RecordChan, ErrChan
+func (h *exportHandler) ListenOrders(ctx context.Context, collection string) error {
+	return h.ExportService.ListenOrders(ctx, collection, func(record domains.RecordHook[domains.PaymentRecord]) {
+		logger := logging.Payment(record.Record.Id, record.Record.UserId, record.Record.Provider, "queue")
+		if err := h.ExportPool.Submit(ctx, collection, record); err != nil {
+			logger.Error("failed to queue payment", "error", err)
+			return
+		}
+		if record.Action == "create" {
+			logger.Info("queued payment", "queueDepth", h.ExportPool.QueueDepth())
+		}
+	})
+}
+
+func (h *exportHandler) QueueDepth() map[domains.PaymentProvider]int {
+	return h.ExportPool.QueueDepth()
 }
 
 // func (h *exportHandler) ExportGGKeystorePayment(collection string, record domains.RecordHook[domains.PaymentRecord]) error {
 // 	return h.ExportService.ExportGGKeyStorePayment(collection, record)
 // }
 
-func (h *exportHandler) ExportPayment(collection string, record domains.RecordHook[domains.PaymentRecord]) error {
-	return h.ExportService.ExportPayment(collection, record)
+func (h *exportHandler) ExportPayment(ctx context.Context, collection string, record domains.RecordHook[domains.PaymentRecord]) error {
+	return h.ExportService.ExportPayment(ctx, collection, record)
 }
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// HealthCheck is one component readiness depends on; it returns an error
+// describing why the component is not ready.
+type HealthCheck struct {
+	Name  string
+	Check func() error
+}
+
+type healthHandler struct {
+	checks []HealthCheck
+}
+
+// NewHealthHandler serves /healthz, which only tells the orchestrator the
+// process is alive, and /readyz, which runs every check and answers 503 with
+// the failing ones so the instance is drained until they recover.
+func NewHealthHandler(checks ...HealthCheck) http.Handler {
+	h := &healthHandler{checks: checks}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", h.liveness)
+	mux.HandleFunc("GET /readyz", h.readiness)
+	return mux
+}
+
+func (h *healthHandler) liveness(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (h *healthHandler) readiness(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	results := make(map[string]string, len(h.checks))
+	for _, check := range h.checks {
+		if err := check.Check(); err != nil {
+			status = http.StatusServiceUnavailable
+			results[check.Name] = err.Error()
+			continue
+		}
+		results[check.Name] = "ok"
+	}
+	writeJSON(w, status, results)
+}
@@ -2,71 +2,132 @@ package handlers
 
 import (
 	"app/internal/domains"
+	"app/internal/logging"
 	"app/internal/services"
-	"log"
+	"app/internal/tracing"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/robfig/cron"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type SchedulerHandler interface {
 	StartVerifyPayment(collection string) error
+	StartExpirePayment(collection string, schedule string, ttl time.Duration) error
+	StartRecoverPayment(ctx context.Context, collection string, schedule string, stuckAfter time.Duration, resumeWithin time.Duration) error
 	Stop()
+	Running() bool
 }
 
+// maxConcurrentVerifications caps how many browsers a verification run opens
+// now that every pending payment is fetched instead of only the first one.
+const maxConcurrentVerifications = 4
+
 type schedulerHandler struct {
 	cron          *cron.Cron
 	verifyService services.VerifyService
-	isRunning     bool
+	exportService services.ExportService
+	exportPool    services.ExportPool
+	lifecycle     services.Lifecycle
+	isRunning     atomic.Bool
 }
 
-func NewSchedulerHandler(verifyService services.VerifyService) SchedulerHandler {
-	return &schedulerHandler{
+func NewSchedulerHandler(verifyService services.VerifyService, exportService services.ExportService, exportPool services.ExportPool, lifecycle services.Lifecycle) SchedulerHandler {
+	h := &schedulerHandler{
 		cron:          cron.New(),
 		verifyService: verifyService,
-		isRunning:     true,
+		exportService: exportService,
+		exportPool:    exportPool,
+		lifecycle:     lifecycle,
 	}
+	h.isRunning.Store(true)
+	return h
 }
 
 func (h *schedulerHandler) StartVerifyPayment(collection string) error {
-	h.cron.AddFunc("@every 1m", func() {
-		pendingPayments, err := h.verifyService.GetPendingPayment()
+	h.cron.AddFunc("@every 1m", h.traced("verify", func(ctx context.Context) error {
+		pendingPayments, err := h.verifyService.GetPendingPayment(ctx)
 		if err != nil {
-			log.Println("Error fetching pending payments:", err)
-			return
+			return fmt.Errorf("failed to fetch pending payments: %w", err)
 		}
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		verifySlots := make(chan struct{}, maxConcurrentVerifications)
 		for _, payment := range pendingPayments {
+			verifySlots <- struct{}{}
+			done, err := h.lifecycle.Begin(services.TaskVerify, collection, payment.Id)
+			if err != nil {
+				<-verifySlots
+				slog.Info("stopping verification run", logging.KeyStage, "verify", "error", err)
+				return nil
+			}
+			wg.Add(1)
 			go func(payment domains.PaymentRecord) {
-				success, err := h.verifyService.VerifyByUrl(payment.PaymentUrl)
-				if err != nil {
-					log.Println("Error verifying payment:", err)
-					return
-				}
-				if success {
-					err = h.verifyService.UpdateOrderStatus(collection, payment.Id, "success", "Payment verified from system")
-					if err != nil {
-						log.Println("Error updating order status:", err)
-						return
-					}
-					err = h.verifyService.AddCredit(payment.UserId, payment.Amount)
-					if err != nil {
-						log.Println("Error adding credit:", err)
-						return
-					}
-				} else {
-					err = h.verifyService.UpdateOrderStatus(collection, payment.Id, "reject", "Payment verification failed")
-					if err != nil {
-						log.Println("Error updating order status:", err)
-						return
-					}
+				defer wg.Done()
+				defer func() { <-verifySlots }()
+				defer done()
+				if _, err := h.verifyService.VerifyPayment(ctx, collection, payment.Id); err != nil {
+					logging.Payment(payment.Id, payment.UserId, payment.Provider, "verify").Error("failed to verify payment", "error", err)
 				}
 			}(payment)
 		}
+		return nil
+	}))
+	h.cron.Start()
+	return nil
+}
+
+func (h *schedulerHandler) StartExpirePayment(collection string, schedule string, ttl time.Duration) error {
+	if err := h.cron.AddFunc(schedule, h.traced("expiry", func(ctx context.Context) error {
+		return h.verifyService.ExpireOverduePayments(ctx, collection, ttl)
+	})); err != nil {
+		return err
+	}
+	h.cron.Start()
+	return nil
+}
+
+// StartRecoverPayment runs a recovery pass right away, to pick up payments a
+// previous process left behind, and then on schedule. Resumed payments go
+// through the export pool like new ones.
+func (h *schedulerHandler) StartRecoverPayment(ctx context.Context, collection string, schedule string, stuckAfter time.Duration, resumeWithin time.Duration) error {
+	recoverPayments := h.tracedWith(ctx, "recovery", func(ctx context.Context) error {
+		return h.exportService.RecoverStuckPayments(ctx, collection, stuckAfter, resumeWithin, h.exportPool.Submit)
 	})
+	if err := h.cron.AddFunc(schedule, recoverPayments); err != nil {
+		return err
+	}
+	go recoverPayments()
 	h.cron.Start()
 	return nil
 }
 
+// traced wraps one scheduled run of stage in a span and logs its error.
+func (h *schedulerHandler) traced(stage string, run func(ctx context.Context) error) func() {
+	return h.tracedWith(h.lifecycle.Context(), stage, run)
+}
+
+func (h *schedulerHandler) tracedWith(ctx context.Context, stage string, run func(ctx context.Context) error) func() {
+	return func() {
+		ctx, span := tracing.Start(ctx, "scheduler "+stage, attribute.String(logging.KeyStage, stage))
+		err := run(ctx)
+		tracing.End(span, err)
+		if err != nil {
+			slog.Error("scheduled run failed", logging.KeyStage, stage, "error", err)
+		}
+	}
+}
+
 func (h *schedulerHandler) Stop() {
 	h.cron.Stop()
-	h.isRunning = false
+	h.isRunning.Store(false)
+}
+
+func (h *schedulerHandler) Running() bool {
+	return h.isRunning.Load()
 }
@@ -0,0 +1,95 @@
+// Package logging configures the process-wide slog logger and carries
+// payment correlation attributes through contexts.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Attribute keys shared by every log line about a payment.
+const (
+	KeyPaymentId = "paymentId"
+	KeyUserId    = "userId"
+	KeyProvider  = "provider"
+	KeyStage     = "stage"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute keys whose values never reach the output:
+// customer phone numbers, QR payloads and credentials.
+var sensitiveKeys = map[string]bool{
+	"phone":         true,
+	"phonenumber":   true,
+	"qrcode":        true,
+	"qrdata":        true,
+	"password":      true,
+	"token":         true,
+	"authorization": true,
+	"email":         true,
+}
+
+// Setup installs the default logger. format is "text" or "json" and level
+// one of debug, info, warn or error.
+func Setup(format string, level string) error {
+	handler, err := NewHandler(os.Stderr, format, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// NewHandler builds a handler that redacts sensitive attributes.
+func NewHandler(w io.Writer, format string, level string) (slog.Handler, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redact}
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	case "text", "":
+		return slog.NewTextHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q", format)
+}
+
+func redact(groups []string, attr slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+	return attr
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a context carrying logger, for code further down the
+// call chain that only has the context.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// From returns the logger stored in ctx, or the default logger.
+func From(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Payment returns a logger tagged with the payment's correlation attributes.
+func Payment(paymentId string, userId string, provider string, stage string) *slog.Logger {
+	return slog.With(
+		KeyPaymentId, paymentId,
+		KeyUserId, userId,
+		KeyProvider, provider,
+		KeyStage, stage,
+	)
+}
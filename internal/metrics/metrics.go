@@ -0,0 +1,93 @@
+// Package metrics holds the Prometheus collectors shared by repositories,
+// services and handlers. They are registered with the default registry,
+// which Handler serves.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	ExportAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_export_attempts_total",
+		Help: "Payment export attempts by provider, method and outcome.",
+	}, []string{"provider", "method", "outcome"})
+
+	SubmitStageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "payment_submit_stage_duration_seconds",
+		Help:    "Time spent reaching each progress stage of a provider export.",
+		Buckets: []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120, 180},
+	}, []string{"provider", "stage"})
+
+	Verifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_verifications_total",
+		Help: "Payment verifications by result.",
+	}, []string{"result"})
+
+	PocketBaseErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pocketbase_request_errors_total",
+		Help: "Failed PocketBase requests by HTTP method and status, or transport for network failures.",
+	}, []string{"method", "status"})
+
+	Reauthentications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reauthentications_total",
+		Help: "Re-authentications of PocketBase and the provider sessions by result.",
+	}, []string{"component", "result"})
+
+	BrowserRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "browser_restarts_total",
+		Help: "Pooled browser instances replaced by profile and reason.",
+	}, []string{"profile", "reason"})
+)
+
+// Outcome labels for ExportAttempts.
+const (
+	OutcomeSuccess    = "success"
+	OutcomeRetryable  = "retryable"
+	OutcomeUserFacing = "user_facing"
+	OutcomeFatal      = "fatal"
+)
+
+// Result labels for Verifications and Reauthentications.
+const (
+	ResultSuccess = "success"
+	ResultReject  = "reject"
+	ResultError   = "error"
+)
+
+// Reason labels for BrowserRestarts.
+const (
+	ReasonCrash        = "crash"
+	ReasonUnresponsive = "unresponsive"
+	ReasonRecycle      = "recycle"
+)
+
+// RegisterBrowserTabs exposes the number of browser tabs held for payments,
+// read from count on every scrape.
+func RegisterBrowserTabs(count func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "browser_tabs",
+		Help: "Browser tabs currently held for payments.",
+	}, func() float64 {
+		return float64(count())
+	})
+}
+
+// RegisterBrowserInstances exposes the number of pooled browser instances,
+// read from count on every scrape.
+func RegisterBrowserInstances(count func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "browser_instances",
+		Help: "Browser instances currently running in the pool.",
+	}, func() float64 {
+		return float64(count())
+	})
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
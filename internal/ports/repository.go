@@ -2,13 +2,17 @@ package ports
 
 import (
 	"app/internal/domains"
-
-	"github.com/shopspring/decimal"
+	"context"
 )
 
 type PaymentRepository interface {
-	NewPayment(id string) (PaymentRepository, error)
-	SubmitPayment(id string, method domains.PaymentMethod, phone string, amount decimal.Decimal, callBackProgress func(uint)) (urlRedirect, qrData, message, orderid string, err error)
-	SubmitOtp(id string, otp string) (urlRedirect, qrData, message string, err error)
+	NewPayment(ctx context.Context, id string) (PaymentRepository, error)
+	SubmitPayment(ctx context.Context, request domains.PaymentRequest, callBackProgress func(uint)) (domains.PaymentResult, error)
+	SubmitOtp(ctx context.Context, id string, otp string) (domains.PaymentResult, error)
+	// Login signs the provider's shared browser in again. Providers that
+	// check out as a guest have nothing to do.
+	Login(ctx context.Context) error
+	// LoggedIn reports whether the last login or session check succeeded.
+	LoggedIn() bool
 	Close()
 }
@@ -0,0 +1,110 @@
+package repositories
+
+import (
+	"app/internal/logging"
+	"app/internal/metrics"
+	"context"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/robfig/cron"
+)
+
+// accountBrowser is the pool profile of a provider that checks out with an
+// account. Every instance of the profile runs login before its first lease,
+// and an hourly check logs in again once the provider dropped the session.
+type accountBrowser struct {
+	login    accountLogin
+	pool     BrowserPool
+	profile  string
+	loggedIn *atomic.Bool
+	cronjob  *cron.Cron
+}
+
+// newAccountBrowser registers profile with pool, starts its first instance
+// so the login is in place before the first payment, and starts the session
+// check. The pool logs in again whenever it replaces an instance, resuming
+// the login saved in the store while the provider still accepts it.
+func newAccountBrowser(pool BrowserPool, profile string, login accountLogin) (*accountBrowser, error) {
+	b := &accountBrowser{
+		login:    login,
+		pool:     pool,
+		profile:  profile,
+		loggedIn: &atomic.Bool{},
+		cronjob:  cron.New(),
+	}
+	pool.Register(BrowserProfile{
+		Name:         profile,
+		MaxInstances: 1,
+		Setup: func(ctx context.Context) error {
+			err := login.establish(ctx)
+			b.loggedIn.Store(err == nil)
+			return err
+		},
+	})
+	warmCtx, cancelWarm := context.WithTimeout(context.Background(), browserWarmTimeout)
+	lease, err := pool.Lease(warmCtx, profile)
+	cancelWarm()
+	if err != nil {
+		return nil, err
+	}
+	lease.Release()
+
+	b.cronjob.AddFunc("@hourly", b.checkSession)
+	b.cronjob.Start()
+	return b, nil
+}
+
+func (b *accountBrowser) checkSession() {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionCheckTimeout)
+	defer cancel()
+	lease, err := b.pool.Lease(ctx, b.profile)
+	if err != nil {
+		slog.Error("failed to check session", logging.KeyProvider, b.login.provider, "error", err)
+		return
+	}
+	defer lease.Release()
+	runCtx, cancelRun := bindContext(ctx, lease.Context())
+	defer cancelRun()
+	loggedIn, err := b.login.check(runCtx)
+	if err != nil {
+		slog.Error("failed to check session", logging.KeyProvider, b.login.provider, "error", err)
+		return
+	}
+	if loggedIn {
+		return
+	}
+	b.loggedIn.Store(false)
+	if err := b.login.full(runCtx); err != nil {
+		slog.Error("failed to re-authenticate", logging.KeyProvider, b.login.provider, "error", err)
+		metrics.Reauthentications.WithLabelValues(string(b.login.provider), metrics.ResultError).Inc()
+		return
+	}
+	b.loggedIn.Store(true)
+	metrics.Reauthentications.WithLabelValues(string(b.login.provider), metrics.ResultSuccess).Inc()
+}
+
+// Login signs the shared browser in again.
+func (b *accountBrowser) Login(ctx context.Context) error {
+	lease, err := b.pool.Lease(ctx, b.profile)
+	if err != nil {
+		return err
+	}
+	defer lease.Release()
+	runCtx, cancel := bindContext(ctx, lease.Context())
+	defer cancel()
+	if err := b.login.full(runCtx); err != nil {
+		return err
+	}
+	b.loggedIn.Store(true)
+	return nil
+}
+
+func (b *accountBrowser) LoggedIn() bool {
+	return b.loggedIn.Load()
+}
+
+// stop ends the session check.
+func (b *accountBrowser) stop() {
+	b.cronjob.Stop()
+}
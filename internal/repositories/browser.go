@@ -0,0 +1,500 @@
+package repositories
+
+import (
+	"app/internal/metrics"
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	cu "github.com/Davincible/chromedp-undetected"
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/chromedp"
+)
+
+// BrowserProfile describes one kind of pooled Chrome instance. Every instance
+// of a profile is started with Flags and then runs Setup, e.g. a provider
+// login, on its first tab; a crashed or recycled instance is replaced the
+// same way.
+type BrowserProfile struct {
+	Name string
+	// MaxInstances caps the instances of this profile below the pool limit;
+	// zero leaves only the pool limit.
+	MaxInstances int
+	Flags        []chromedp.ExecAllocatorOption
+	// Isolated opens every lease in its own browser context, so leases of a
+	// guest checkout share no cookies.
+	Isolated bool
+	Setup    func(ctx context.Context) error
+}
+
+// BrowserLease is a tab leased from a BrowserPool. Release closes the tab and
+// frees its slot; it is safe to call more than once.
+type BrowserLease struct {
+	ctx     context.Context
+	release func()
+}
+
+// Context is the chromedp context of the leased tab.
+func (l *BrowserLease) Context() context.Context {
+	return l.ctx
+}
+
+func (l *BrowserLease) Release() {
+	l.release()
+}
+
+// BrowserStats describes a running instance.
+type BrowserStats struct {
+	Profile   string    `json:"profile"`
+	StartedAt time.Time `json:"startedAt"`
+	Tabs      int       `json:"tabs"`
+	Retiring  bool      `json:"retiring"`
+}
+
+// BrowserPool shares Chrome instances between the providers. It starts at
+// most maxInstances browsers with at most maxTabs leased tabs each, keeps
+// spares idle instances of every registered profile warm, replaces
+// instances that crash or stop answering and recycles them once they are
+// older than recycleAfter to cap their memory.
+type BrowserPool interface {
+	Register(profile BrowserProfile)
+	// Lease returns a tab on an instance of profile, starting one if none has
+	// a free tab, and waits for a slot while the pool is full.
+	Lease(ctx context.Context, profile string) (*BrowserLease, error)
+	Stats() []BrowserStats
+	// Start runs crash detection, recycling and spare upkeep until ctx is
+	// done.
+	Start(ctx context.Context)
+	Close()
+}
+
+// browserCheckInterval is how often instances are pinged, recycled and
+// topped up with spares.
+const browserCheckInterval = 30 * time.Second
+
+// browserPingTimeout is how long an instance gets to answer a ping before it
+// is considered hung and replaced.
+const browserPingTimeout = 10 * time.Second
+
+type browserInstance struct {
+	profile   string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	startedAt time.Time
+	tabs      int
+	retiring  bool
+	closing   bool
+}
+
+type browserPool struct {
+	mu           sync.Mutex
+	maxInstances int
+	maxTabs      int
+	spares       int
+	recycleAfter time.Duration
+	profiles     map[string]BrowserProfile
+	instances    []*browserInstance
+	starting     map[string]int
+	// waiting counts Leases blocked on the pool limit; spares are not
+	// topped up while any wait, so freed slots go to them.
+	waiting int
+	changed chan struct{}
+	wake    chan struct{}
+	closed  bool
+}
+
+func NewBrowserPool(maxInstances int, maxTabs int, spares int, recycleAfter time.Duration) BrowserPool {
+	return &browserPool{
+		maxInstances: max(maxInstances, 1),
+		maxTabs:      max(maxTabs, 1),
+		spares:       spares,
+		recycleAfter: recycleAfter,
+		profiles:     map[string]BrowserProfile{},
+		starting:     map[string]int{},
+		changed:      make(chan struct{}),
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+func (p *browserPool) Register(profile BrowserProfile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.profiles[profile.Name] = profile
+	p.signal()
+}
+
+func (p *browserPool) Lease(ctx context.Context, name string) (*BrowserLease, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("browser pool is closed")
+		}
+		profile, ok := p.profiles[name]
+		if !ok {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("browser profile %q is not registered", name)
+		}
+		if inst := p.pick(name); inst != nil {
+			inst.tabs++
+			p.signal()
+			p.mu.Unlock()
+			return p.lease(inst, profile), nil
+		}
+		if p.canStart(profile) {
+			p.starting[name]++
+			p.mu.Unlock()
+			inst, err := p.start(profile)
+			p.mu.Lock()
+			p.starting[name]--
+			if err != nil {
+				p.broadcast()
+				p.mu.Unlock()
+				return nil, err
+			}
+			if p.closed {
+				inst.closing = true
+				p.mu.Unlock()
+				inst.cancel()
+				return nil, fmt.Errorf("browser pool is closed")
+			}
+			inst.tabs++
+			p.add(inst)
+			p.signal()
+			p.mu.Unlock()
+			return p.lease(inst, profile), nil
+		}
+		full := !p.atProfileLimit(profile)
+		if full {
+			p.reclaim(name)
+			p.waiting++
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		var err error
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			err = fmt.Errorf("waiting for a %s browser: %w", name, ctx.Err())
+		}
+		if full {
+			p.mu.Lock()
+			p.waiting--
+			p.mu.Unlock()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// reclaim stops the oldest idle instance of another profile so a Lease of
+// name that finds the pool full gets its slot instead of waiting behind
+// spares. Only one instance is stopped at a time: the slot of an instance
+// already closing is on its way.
+func (p *browserPool) reclaim(name string) {
+	var victim *browserInstance
+	for _, inst := range p.instances {
+		if inst.closing {
+			return
+		}
+		if victim == nil && inst.profile != name && inst.tabs == 0 {
+			victim = inst
+		}
+	}
+	if victim != nil {
+		slog.Info("stopping idle browser for another profile", "profile", victim.profile, "for", name)
+		p.stop(victim)
+	}
+}
+
+// pick returns the busiest instance of profile that still has a free tab, so
+// idle instances stay spare.
+func (p *browserPool) pick(name string) *browserInstance {
+	var best *browserInstance
+	for _, inst := range p.instances {
+		if inst.profile != name || inst.retiring || inst.closing || inst.tabs >= p.maxTabs {
+			continue
+		}
+		if best == nil || inst.tabs > best.tabs {
+			best = inst
+		}
+	}
+	return best
+}
+
+func (p *browserPool) canStart(profile BrowserProfile) bool {
+	if p.atProfileLimit(profile) {
+		return false
+	}
+	total := len(p.instances)
+	for _, n := range p.starting {
+		total += n
+	}
+	return total < p.maxInstances
+}
+
+// atProfileLimit reports whether profile already runs its MaxInstances.
+func (p *browserPool) atProfileLimit(profile BrowserProfile) bool {
+	if profile.MaxInstances <= 0 {
+		return false
+	}
+	own := p.starting[profile.Name]
+	for _, inst := range p.instances {
+		if inst.profile == profile.Name {
+			own++
+		}
+	}
+	return own >= profile.MaxInstances
+}
+
+func (p *browserPool) lease(inst *browserInstance, profile BrowserProfile) *BrowserLease {
+	var opts []chromedp.ContextOption
+	if profile.Isolated {
+		opts = append(opts, chromedp.WithNewBrowserContext())
+	}
+	tabCtx, cancelTab := chromedp.NewContext(inst.ctx, opts...)
+	var once sync.Once
+	return &BrowserLease{
+		ctx: tabCtx,
+		release: func() {
+			once.Do(func() {
+				cancelTab()
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				inst.tabs--
+				if inst.retiring && inst.tabs == 0 {
+					p.stop(inst)
+				}
+				p.broadcast()
+			})
+		},
+	}
+}
+
+// start launches a Chrome instance for profile and runs its Setup.
+func (p *browserPool) start(profile BrowserProfile) (*browserInstance, error) {
+	ctx, cancel, err := cu.New(cu.NewConfig(cu.WithChromeFlags(profile.Flags...)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start %s browser: %w", profile.Name, err)
+	}
+	if err := chromedp.Run(ctx); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start %s browser: %w", profile.Name, err)
+	}
+	if profile.Setup != nil {
+		if err := profile.Setup(ctx); err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to set up %s browser: %w", profile.Name, err)
+		}
+	}
+	slog.Info("browser started", "profile", profile.Name)
+	return &browserInstance{
+		profile:   profile.Name,
+		ctx:       ctx,
+		cancel:    cancel,
+		startedAt: time.Now(),
+	}, nil
+}
+
+// add tracks inst and watches it: chromedp cancels the instance context when
+// the connection to Chrome is lost, so a done context the pool did not
+// cancel itself means the browser crashed.
+func (p *browserPool) add(inst *browserInstance) {
+	p.instances = append(p.instances, inst)
+	go func() {
+		<-inst.ctx.Done()
+		p.mu.Lock()
+		crashed := !inst.closing
+		tabs := inst.tabs
+		p.remove(inst)
+		p.broadcast()
+		p.signal()
+		p.mu.Unlock()
+		if crashed {
+			slog.Error("browser crashed", "profile", inst.profile, "tabs", tabs)
+			metrics.BrowserRestarts.WithLabelValues(inst.profile, metrics.ReasonCrash).Inc()
+		}
+	}()
+}
+
+func (p *browserPool) remove(inst *browserInstance) {
+	for i, other := range p.instances {
+		if other == inst {
+			p.instances = append(p.instances[:i], p.instances[i+1:]...)
+			return
+		}
+	}
+}
+
+// stop closes inst; its tabs, if any, are cancelled with it.
+func (p *browserPool) stop(inst *browserInstance) {
+	if inst.closing {
+		return
+	}
+	inst.closing = true
+	go inst.cancel()
+}
+
+// broadcast wakes every Lease waiting for a slot.
+func (p *browserPool) broadcast() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// signal asks the maintenance loop to top up spares without waiting for the
+// ticker.
+func (p *browserPool) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *browserPool) Start(ctx context.Context) {
+	ticker := time.NewTicker(browserCheckInterval)
+	defer ticker.Stop()
+	p.fillSpares()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.ping()
+			p.recycle()
+		case <-p.wake:
+		}
+		p.fillSpares()
+	}
+}
+
+// ping replaces instances that no longer answer the DevTools protocol.
+func (p *browserPool) ping() {
+	p.mu.Lock()
+	instances := append([]*browserInstance(nil), p.instances...)
+	p.mu.Unlock()
+	for _, inst := range instances {
+		pingCtx, cancel := context.WithTimeout(inst.ctx, browserPingTimeout)
+		err := chromedp.Run(pingCtx, chromedp.ActionFunc(func(ctx context.Context) error {
+			_, _, _, _, _, err := browser.GetVersion().Do(ctx)
+			return err
+		}))
+		cancel()
+		if err == nil || inst.ctx.Err() != nil {
+			continue
+		}
+		slog.Error("browser stopped responding", "profile", inst.profile, "error", err)
+		metrics.BrowserRestarts.WithLabelValues(inst.profile, metrics.ReasonUnresponsive).Inc()
+		p.mu.Lock()
+		p.stop(inst)
+		p.mu.Unlock()
+	}
+}
+
+// recycle retires instances older than recycleAfter; they take no new
+// leases and are closed once their last tab is released.
+func (p *browserPool) recycle() {
+	if p.recycleAfter <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, inst := range p.instances {
+		if inst.retiring || inst.closing || time.Since(inst.startedAt) < p.recycleAfter {
+			continue
+		}
+		inst.retiring = true
+		metrics.BrowserRestarts.WithLabelValues(inst.profile, metrics.ReasonRecycle).Inc()
+		if inst.tabs == 0 {
+			p.stop(inst)
+		}
+	}
+}
+
+// fillSpares starts instances until every registered profile has spares idle
+// ones or the pool is full.
+func (p *browserPool) fillSpares() {
+	p.mu.Lock()
+	names := make([]string, 0, len(p.profiles))
+	for name := range p.profiles {
+		names = append(names, name)
+	}
+	p.mu.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		for {
+			p.mu.Lock()
+			profile := p.profiles[name]
+			if p.closed || p.waiting > 0 || p.idle(name) >= p.spares || !p.canStart(profile) {
+				p.mu.Unlock()
+				break
+			}
+			p.starting[name]++
+			p.mu.Unlock()
+
+			inst, err := p.start(profile)
+			p.mu.Lock()
+			p.starting[name]--
+			if err == nil {
+				if p.closed {
+					inst.closing = true
+					inst.cancel()
+				} else {
+					p.add(inst)
+				}
+			}
+			p.broadcast()
+			p.mu.Unlock()
+			if err != nil {
+				slog.Error("failed to start spare browser", "profile", name, "error", err)
+				break
+			}
+		}
+	}
+}
+
+func (p *browserPool) idle(name string) int {
+	idle := p.starting[name]
+	for _, inst := range p.instances {
+		if inst.profile == name && inst.tabs == 0 && !inst.retiring && !inst.closing {
+			idle++
+		}
+	}
+	return idle
+}
+
+func (p *browserPool) Stats() []BrowserStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make([]BrowserStats, 0, len(p.instances))
+	for _, inst := range p.instances {
+		stats = append(stats, BrowserStats{
+			Profile:   inst.profile,
+			StartedAt: inst.startedAt,
+			Tabs:      inst.tabs,
+			Retiring:  inst.retiring,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].StartedAt.Before(stats[j].StartedAt)
+	})
+	return stats
+}
+
+func (p *browserPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, inst := range p.instances {
+		if !inst.closing {
+			inst.closing = true
+			inst.cancel()
+		}
+	}
+	p.broadcast()
+}
@@ -1,9 +1,141 @@
 package repositories
 
 import (
+	"app/internal/domains"
+	"app/internal/logging"
+	"app/internal/tracing"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"strings"
 	"time"
 
-	"github.com/patrickmn/go-cache"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/chromedp/chromedp"
+	goqr "github.com/liyue201/goqr"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var chromdpWorker = cache.New(time.Hour, time.Hour)
+// promptPayQrLifetime is how long the gateways keep a PromptPay QR payable.
+const promptPayQrLifetime = 10 * time.Minute
+
+// sessionCheckTimeout bounds a periodic provider session check, including
+// the wait for a browser tab.
+const sessionCheckTimeout = 5 * time.Minute
+
+// browserWarmTimeout bounds how long a provider waits for a browser slot when
+// it starts, so a full pool fails the start instead of hanging the caller.
+const browserWarmTimeout = 2 * time.Minute
+
+// stepTimeout bounds a single chromedp.Run so a selector that never shows up
+// fails on its own instead of eating the whole attempt.
+const stepTimeout = 45 * time.Second
+
+// bindContext derives a context from tabCtx, so chromedp actions still run on
+// the tab, that is also cancelled when the caller's ctx is done and carries
+// its span and logger.
+func bindContext(ctx context.Context, tabCtx context.Context) (context.Context, context.CancelFunc) {
+	runCtx, cancel := context.WithCancelCause(tabCtx)
+	runCtx = trace.ContextWithSpan(runCtx, trace.SpanFromContext(ctx))
+	runCtx = logging.WithLogger(runCtx, logging.From(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		cancel(callerDone{ctx.Err()})
+	})
+	return runCtx, func() {
+		stop()
+		cancel(context.Canceled)
+	}
+}
+
+// callerDone is the cancel cause of a bound context whose caller is done, so
+// runStep can tell it apart from the tab dying under a live caller.
+type callerDone struct {
+	err error
+}
+
+func (e callerDone) Error() string {
+	return e.err.Error()
+}
+
+func (e callerDone) Unwrap() error {
+	return e.err
+}
+
+// runStep runs actions under stepTimeout in a span named after the step and
+// maps the failure onto the domains error taxonomy.
+func runStep(ctx context.Context, name string, actions ...chromedp.Action) (err error) {
+	ctx, span := tracing.Start(ctx, "chromedp "+name)
+	defer func() { tracing.End(span, err) }()
+	stepCtx, cancel := context.WithTimeout(ctx, stepTimeout)
+	defer cancel()
+	err = chromedp.Run(stepCtx, actions...)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		var done callerDone
+		if !errors.As(context.Cause(ctx), &done) {
+			// The caller is still waiting but the tab is gone, e.g. its
+			// browser crashed or was stopped; another provider may succeed.
+			return fmt.Errorf("%w: %v", domains.ErrBrowserClosed, context.Cause(ctx))
+		}
+		if errors.Is(done.err, context.DeadlineExceeded) {
+			return fmt.Errorf("%w: %v", domains.ErrTimeout, err)
+		}
+		return done.err
+	}
+	if errors.Is(stepCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", domains.ErrSelectorNotFound, err)
+	}
+	return err
+}
+
+// runTraced is chromedp.Run in a span, for runs that are not a payment step
+// such as logging in.
+func runTraced(ctx context.Context, name string, actions ...chromedp.Action) (err error) {
+	ctx, span := tracing.Start(ctx, "chromedp "+name)
+	defer func() { tracing.End(span, err) }()
+	return chromedp.Run(ctx, actions...)
+}
+
+// screenshots captures the tab for support. Providers take it once the QR
+// is decoded, so a failure is only logged and the payment goes on without
+// one.
+func screenshots(ctx context.Context) [][]byte {
+	var screenshot []byte
+	if err := runStep(ctx, "screenshot", chromedp.CaptureScreenshot(&screenshot)); err != nil {
+		logging.From(ctx).Warn("failed to take screenshot", "error", err)
+		return nil
+	}
+	return [][]byte{screenshot}
+}
+
+// decodeQr reads the payload of the first QR code in a data:image src.
+func decodeQr(ctx context.Context, src string) (payload string, err error) {
+	_, span := tracing.Start(ctx, "decode qr")
+	defer func() { tracing.End(span, err) }()
+	base64Str := strings.TrimPrefix(src, "data:image/png;base64,")
+	base64Str = strings.TrimPrefix(base64Str, "data:image/jpeg;base64,")
+	imgBytes, err := base64.StdEncoding.DecodeString(base64Str)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", domains.ErrQrNotDecodable, err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(imgBytes))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", domains.ErrQrNotDecodable, err)
+	}
+	codes, err := goqr.Recognize(img)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", domains.ErrQrNotDecodable, err)
+	}
+	if len(codes) == 0 {
+		return "", fmt.Errorf("%w: no QR code found in image", domains.ErrQrNotDecodable)
+	}
+	// use the first detected QR code payload
+	return string(codes[0].Payload), nil
+}
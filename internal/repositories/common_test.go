@@ -0,0 +1,62 @@
+package repositories
+
+import (
+	"app/internal/domains"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/chromedp/chromedp"
+)
+
+// The contexts below carry no browser, so chromedp.Run fails at once and
+// runStep only has the contexts to classify the failure by.
+func TestRunStepMapsCancellation(t *testing.T) {
+	tests := []struct {
+		name string
+		stop func(cancelCaller, cancelTab context.CancelFunc)
+		want error
+	}{
+		{"live", func(_, _ context.CancelFunc) {}, chromedp.ErrInvalidContext},
+		{"tab closed", func(_, cancelTab context.CancelFunc) { cancelTab() }, domains.ErrBrowserClosed},
+		{"caller cancelled", func(cancelCaller, _ context.CancelFunc) { cancelCaller() }, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancelCaller := context.WithCancel(context.Background())
+			defer cancelCaller()
+			tabCtx, cancelTab := context.WithCancel(context.Background())
+			defer cancelTab()
+			runCtx, cancel := bindContext(ctx, tabCtx)
+			defer cancel()
+
+			tt.stop(cancelCaller, cancelTab)
+			if tt.want != chromedp.ErrInvalidContext {
+				<-runCtx.Done()
+			}
+			err := runStep(runCtx, "test")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("runStep() = %v, want %v", err, tt.want)
+			}
+			if tt.want == context.Canceled && errors.Is(err, domains.ErrBrowserClosed) {
+				t.Fatalf("runStep() = %v, caller cancellation reported as a closed tab", err)
+			}
+		})
+	}
+}
+
+func TestRunStepMapsCallerDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	runCtx, cancelRun := bindContext(ctx, context.Background())
+	defer cancelRun()
+	<-runCtx.Done()
+
+	err := runStep(runCtx, "test")
+	if !errors.Is(err, domains.ErrTimeout) {
+		t.Fatalf("runStep() = %v, want %v", err, domains.ErrTimeout)
+	}
+	if domains.ClassifyError(err) != domains.Retryable {
+		t.Fatalf("ClassifyError(%v) = %v, want Retryable", err, domains.ClassifyError(err))
+	}
+}
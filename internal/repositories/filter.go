@@ -0,0 +1,143 @@
+package repositories
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Filter is a PocketBase filter expression. Values are always escaped when
+// they are added, so a quote in an id or user input cannot change the query.
+// The zero Filter matches every record.
+type Filter struct {
+	expr string
+}
+
+// Macro is a PocketBase datetime macro, emitted unquoted.
+type Macro string
+
+const (
+	Now        Macro = "@now"
+	TodayStart Macro = "@todayStart"
+	TodayEnd   Macro = "@todayEnd"
+	MonthStart Macro = "@monthStart"
+	MonthEnd   Macro = "@monthEnd"
+	YearStart  Macro = "@yearStart"
+	YearEnd    Macro = "@yearEnd"
+	Yesterday  Macro = "@yesterday"
+	Tomorrow   Macro = "@tomorrow"
+)
+
+func (f Filter) String() string {
+	return f.expr
+}
+
+func (f Filter) IsZero() bool {
+	return f.expr == ""
+}
+
+func Eq(field string, value any) Filter      { return compare(field, "=", value) }
+func Neq(field string, value any) Filter     { return compare(field, "!=", value) }
+func Gt(field string, value any) Filter      { return compare(field, ">", value) }
+func Gte(field string, value any) Filter     { return compare(field, ">=", value) }
+func Lt(field string, value any) Filter      { return compare(field, "<", value) }
+func Lte(field string, value any) Filter     { return compare(field, "<=", value) }
+func Like(field string, value any) Filter    { return compare(field, "~", value) }
+func NotLike(field string, value any) Filter { return compare(field, "!~", value) }
+
+func And(filters ...Filter) Filter {
+	return join(" && ", filters)
+}
+
+func Or(filters ...Filter) Filter {
+	return join(" || ", filters)
+}
+
+func compare(field string, op string, value any) Filter {
+	return Filter{expr: fmt.Sprintf("%s %s %s", field, op, formatValue(value))}
+}
+
+func join(sep string, filters []Filter) Filter {
+	parts := make([]string, 0, len(filters))
+	for _, f := range filters {
+		if !f.IsZero() {
+			parts = append(parts, f.expr)
+		}
+	}
+	switch len(parts) {
+	case 0:
+		return Filter{}
+	case 1:
+		return Filter{expr: parts[0]}
+	}
+	return Filter{expr: "(" + strings.Join(parts, sep) + ")"}
+}
+
+// formatValue renders value as a filter literal the same way the official
+// SDK's pb.filter does: strings are single quoted with quotes escaped, times
+// use the PocketBase datetime layout and anything else falls back to JSON.
+func formatValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case Macro:
+		return string(v)
+	case time.Time:
+		return quote(v.UTC().Format(DateTimeLayout))
+	case decimal.Decimal:
+		return v.String()
+	case fmt.Stringer:
+		return quote(v.String())
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.String:
+		return quote(rv.String())
+	case reflect.Bool:
+		return strconv.FormatBool(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(rv.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(rv.Float(), 'f', -1, 64)
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return quote(fmt.Sprint(value))
+	}
+	return quote(string(raw))
+}
+
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `\'`) + "'"
+}
+
+// Sort is a PocketBase sort expression built from Asc and Desc fields.
+type Sort struct {
+	expr string
+}
+
+type SortField string
+
+func Asc(field string) SortField  { return SortField(field) }
+func Desc(field string) SortField { return SortField("-" + field) }
+
+func SortBy(fields ...SortField) Sort {
+	parts := make([]string, 0, len(fields))
+	for _, f := range fields {
+		parts = append(parts, string(f))
+	}
+	return Sort{expr: strings.Join(parts, ",")}
+}
+
+func (s Sort) String() string {
+	return s.expr
+}
@@ -0,0 +1,84 @@
+package repositories
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", `''`},
+		{"abc", `'abc'`},
+		{"o'brien", `'o\'brien'`},
+		{"' || id != '", `'\' || id != \''`},
+	}
+	for _, tt := range tests {
+		if got := quote(tt.in); got != tt.want {
+			t.Errorf("quote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	type status string
+	tests := []struct {
+		name  string
+		value any
+		want  string
+	}{
+		{"nil", nil, "null"},
+		{"macro", Now, "@now"},
+		{"string", "pending", `'pending'`},
+		{"string kind", status("user-paying"), `'user-paying'`},
+		{"quote", "a'b", `'a\'b'`},
+		{"bool", true, "true"},
+		{"int", -42, "-42"},
+		{"uint", uint8(7), "7"},
+		{"float", 1.5, "1.5"},
+		{"decimal", decimal.RequireFromString("100.50"), "100.5"},
+		{"time", time.Date(2024, 5, 6, 7, 8, 9, 10_000_000, time.FixedZone("ICT", 7*60*60)), `'2024-05-06 00:08:09.010Z'`},
+		{"json", []string{"a"}, `'["a"]'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatValue(tt.value); got != tt.want {
+				t.Errorf("formatValue(%v) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterGrouping(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		want   string
+	}{
+		{"empty and", And(), ""},
+		{"zero parts dropped", And(Filter{}, Eq("id", "x"), Filter{}), `id = 'x'`},
+		{"and", And(Eq("a", 1), Neq("b", 2)), `(a = 1 && b != 2)`},
+		{"or", Or(Gt("a", 1), Lte("b", 2)), `(a > 1 || b <= 2)`},
+		{
+			"or inside and",
+			And(Eq("status", "user-paying"), Or(Lt("expiresAt", Now), Like("note", "x"))),
+			`(status = 'user-paying' && (expiresAt < @now || note ~ 'x'))`,
+		},
+		{
+			"and inside or",
+			Or(And(Eq("a", 1), Eq("b", 2)), NotLike("c", "y")),
+			`((a = 1 && b = 2) || c !~ 'y')`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.String(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,104 +2,104 @@ package repositories
 
 import (
 	"app/internal/domains"
+	"app/internal/logging"
 	"app/internal/ports"
 	"context"
-	"errors"
+	"fmt"
+	"log/slog"
 	"strings"
 	"time"
 
-	"bytes"
-	"encoding/base64"
-	"image"
-	_ "image/jpeg"
-	_ "image/png"
-
-	cu "github.com/Davincible/chromedp-undetected"
 	"github.com/chromedp/chromedp"
-	goqr "github.com/liyue201/goqr"
-	"github.com/patrickmn/go-cache"
-	"github.com/shopspring/decimal"
 )
 
 type ggkeystore struct {
-	mainCtx        context.Context
-	mainCancelFunc context.CancelFunc
+	*accountBrowser
+	id string
 
 	tabCtx        context.Context
 	tabCancelFunc context.CancelFunc
 }
 
-func NewGgkeystore(email, password string) ports.PaymentRepository {
-	ctx, cancel, err := cu.New(cu.NewConfig())
-	if err != nil {
-		return nil
-	}
+// ggkeystoreCapabilities asks for an OTP: ggkeystore confirms the order
+// with a code sent to the account, entered through SubmitOtp.
+var ggkeystoreCapabilities = domains.ProviderCapabilities{
+	Provider:    domains.Ggkeystore,
+	Methods:     []domains.PaymentMethod{domains.PromptPay},
+	RequiresOtp: true,
+}
 
-	if err := chromedp.Run(ctx,
-		chromedp.Navigate("https://www.ggkeystore.com/login"),
-	); err != nil {
-		return nil
+// NewGgkeystore signs email in to ggkeystore. It returns nil when the first
+// browser does not start.
+func NewGgkeystore(email, password string, pool BrowserPool, store LoginStore) ports.PaymentRepository {
+	login := accountLogin{
+		store:       store,
+		provider:    domains.Ggkeystore,
+		account:     string(domains.Ggkeystore) + ":" + email,
+		origins:     []string{"https://www.ggkeystore.com"},
+		checkURL:    "https://www.ggkeystore.com/topup",
+		loginMarker: "/login",
+		login: func() chromedp.Tasks {
+			return ggkeystoreLogin(email, password)
+		},
 	}
-
-	if err := chromedp.Run(ctx,
-		chromedp.WaitVisible(`input[name="email"]`, chromedp.ByQuery),
-		chromedp.SetValue(`input[name="email"]`, email),
-		chromedp.SetValue(`input[name="password"]`, password),
-		chromedp.Click(`button[type="submit"]`, chromedp.ByQuery),
-		chromedp.WaitReady(`form[action="https://www.ggkeystore.com/logout"]`, chromedp.ByQuery),
-	); err != nil {
+	browser, err := newAccountBrowser(pool, string(domains.Ggkeystore), login)
+	if err != nil {
+		slog.Error("failed to start browser", logging.KeyProvider, domains.Ggkeystore, "error", err)
 		return nil
 	}
-
-	browserCtx, cancelBrowser := chromedp.NewContext(ctx)
-
-	gg := &ggkeystore{
-		mainCtx: browserCtx,
-		mainCancelFunc: func() {
-			cancel()
-			cancelBrowser()
-		},
-	}
-
-	return gg
+	return &ggkeystore{accountBrowser: browser}
 }
 
-func (g *ggkeystore) NewPayment(id string) (ports.PaymentRepository, error) {
-	tabCtx, cancelTab := chromedp.NewContext(g.mainCtx)
+func (g *ggkeystore) NewPayment(ctx context.Context, id string) (ports.PaymentRepository, error) {
+	lease, err := g.pool.Lease(ctx, g.profile)
+	if err != nil {
+		return nil, err
+	}
 	gg := &ggkeystore{
-		mainCtx:        g.mainCtx,
-		mainCancelFunc: g.mainCancelFunc,
-		tabCtx:         tabCtx,
-		tabCancelFunc:  cancelTab,
+		accountBrowser: g.accountBrowser,
+		id:             id,
+		tabCtx:         lease.Context(),
+		tabCancelFunc:  lease.Release,
 	}
-	chromdpWorker.Set(id, gg, cache.DefaultExpiration)
+	chromdpWorker.Set(id, domains.Ggkeystore, gg)
 	return gg, nil
 }
 
-func (g *ggkeystore) SubmitPayment(id string, method domains.PaymentMethod, phone string, amount decimal.Decimal, callBackProgress func(uint)) (urlRedirect, qrData, message, orderid string, err error) {
-	err = chromedp.Run(g.tabCtx,
+func (g *ggkeystore) SubmitPayment(ctx context.Context, request domains.PaymentRequest, callBackProgress func(uint)) (result domains.PaymentResult, err error) {
+	runCtx, cancel := bindContext(ctx, g.tabCtx)
+	defer cancel()
+
+	var topupURL string
+	err = runStep(runCtx, "navigate topup",
 		chromedp.Navigate("https://www.ggkeystore.com/topup"),
+		chromedp.Location(&topupURL),
 	)
 	if err != nil {
 		return
 	}
+	if strings.Contains(topupURL, "/login") {
+		g.loggedIn.Store(false)
+		err = domains.ErrProviderLoggedOut
+		return
+	}
 
-	err = chromedp.Run(g.tabCtx,
+	err = runStep(runCtx, "wait topup form",
 		chromedp.WaitVisible(`input#amount`, chromedp.ByQuery),
 	)
 	if err != nil {
 		return
 	}
 
-	err = chromedp.Run(g.tabCtx,
+	err = runStep(runCtx, "set amount",
 		chromedp.WaitVisible(`input#amount`, chromedp.ByQuery),
-		chromedp.SetValue(`input#amount`, amount.String(), chromedp.ByQuery),
+		chromedp.SetValue(`input#amount`, request.Amount.String(), chromedp.ByQuery),
 	)
 	if err != nil {
 		return
 	}
 
-	err = chromedp.Run(g.tabCtx,
+	err = runStep(runCtx, "submit topup",
 		chromedp.WaitVisible(`button[type="submit"].btn-success`, chromedp.ByQuery),
 		chromedp.Sleep(1*time.Second), // wait for 1 second before clicking
 		chromedp.Click(`button[type="submit"].btn-success`, chromedp.ByQuery),
@@ -110,8 +110,9 @@ func (g *ggkeystore) SubmitPayment(id string, method domains.PaymentMethod, phon
 
 	foundImage := false
 	qrBase64 := ""
+	orderid := ""
 
-	err = chromedp.Run(g.tabCtx,
+	err = runStep(runCtx, "choose qr channel",
 		chromedp.WaitVisible(`//p[@class="channel" and contains(text(),"ชำระผ่านคิวอาร์")]`, chromedp.BySearch),
 		chromedp.Click(`//p[@class="channel" and contains(text(),"ชำระผ่านคิวอาร์")]`, chromedp.BySearch),
 		chromedp.WaitVisible(`//p[@class="channel" and contains(text(),"พร้อมเพย์")]`, chromedp.BySearch),
@@ -122,7 +123,7 @@ func (g *ggkeystore) SubmitPayment(id string, method domains.PaymentMethod, phon
 		return
 	}
 	callBackProgress(20)
-	err = chromedp.Run(g.tabCtx,
+	err = runStep(runCtx, "wait qr page",
 		chromedp.Sleep(2*time.Second), // wait for the QR code to load
 		chromedp.WaitReady(`h1.box-merchant-payment-bar-info-h1`, chromedp.ByQuery),
 		chromedp.Text(`h1.box-merchant-payment-bar-info-h1`, &orderid, chromedp.ByQuery),
@@ -130,8 +131,11 @@ func (g *ggkeystore) SubmitPayment(id string, method domains.PaymentMethod, phon
 	if err != nil {
 		return
 	}
+	// The order exists from here on; report it even if a later step fails so
+	// the export does not fail over and create a second one.
+	result.OrderId = orderid
 	callBackProgress(30)
-	err = chromedp.Run(g.tabCtx,
+	err = runStep(runCtx, "read qr",
 		chromedp.WaitReady(`img#qr-pay`, chromedp.ByQuery),
 		chromedp.WaitVisible(`img#qr-pay`, chromedp.ByQuery),
 		chromedp.AttributeValue(`img#qr-pay`, "src", &qrBase64, &foundImage, chromedp.ByQuery),
@@ -141,43 +145,26 @@ func (g *ggkeystore) SubmitPayment(id string, method domains.PaymentMethod, phon
 	}
 	callBackProgress(40)
 	if !foundImage {
-		err = errors.New("failed to find QR code image")
+		err = fmt.Errorf("%w: img#qr-pay has no src", domains.ErrSelectorNotFound)
 		return
 	}
-	// extract QR data from qrBase64 data:image/png;base64,iVBORw0K...
-	// NOTE: requires adding imports:
-
-	base64Str := strings.TrimPrefix(qrBase64, "data:image/png;base64,")
-	base64Str = strings.TrimPrefix(base64Str, "data:image/jpeg;base64,")
-	imgBytes, decodeErr := base64.StdEncoding.DecodeString(base64Str)
-	if decodeErr != nil {
-		err = decodeErr
-		return
-	}
-	callBackProgress(50)
-	img, _, decodeErr := image.Decode(bytes.NewReader(imgBytes))
-	if decodeErr != nil {
-		err = decodeErr
-		return
-	}
-	codes, scanErr := goqr.Recognize(img)
-	if scanErr != nil {
-		err = scanErr
+	qrData, err := decodeQr(ctx, qrBase64)
+	if err != nil {
 		return
 	}
 	callBackProgress(60)
-	if len(codes) == 0 {
-		err = errors.New("no QR code found in image")
-		return
-	}
-	// use the first detected QR code payload
-	qrData = string(codes[0].Payload)
+	result.QrData = qrData
+	result.ExpiresAt = time.Now().Add(promptPayQrLifetime)
+	result.Screenshots = screenshots(runCtx)
 	callBackProgress(70)
 	return
 }
 
-func (g *ggkeystore) SubmitOtp(id string, otp string) (urlRedirect, qrData, message string, err error) {
-	err = chromedp.Run(g.tabCtx,
+func (g *ggkeystore) SubmitOtp(ctx context.Context, id string, otp string) (result domains.PaymentResult, err error) {
+	runCtx, cancel := bindContext(ctx, g.tabCtx)
+	defer cancel()
+
+	err = runStep(runCtx, "submit otp",
 		chromedp.WaitVisible(`input#otp`, chromedp.ByQuery),
 		chromedp.SetValue(`input#otp`, otp, chromedp.ByQuery),
 		chromedp.Click(`button[type="submit"].btn-success`, chromedp.ByQuery),
@@ -185,10 +172,22 @@ func (g *ggkeystore) SubmitOtp(id string, otp string) (urlRedirect, qrData, mess
 	return
 }
 
+func ggkeystoreLogin(email, password string) chromedp.Tasks {
+	return chromedp.Tasks{
+		chromedp.Navigate("https://www.ggkeystore.com/login"),
+		chromedp.WaitVisible(`input[name="email"]`, chromedp.ByQuery),
+		chromedp.SetValue(`input[name="email"]`, email),
+		chromedp.SetValue(`input[name="password"]`, password),
+		chromedp.Click(`button[type="submit"]`, chromedp.ByQuery),
+		chromedp.WaitReady(`form[action="https://www.ggkeystore.com/logout"]`, chromedp.ByQuery),
+	}
+}
+
 func (g *ggkeystore) Close() {
 	if g.tabCancelFunc != nil {
 		g.tabCancelFunc()
+		chromdpWorker.Remove(g.id, g)
 	} else {
-		g.mainCancelFunc()
+		g.stop()
 	}
 }
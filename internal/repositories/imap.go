@@ -2,7 +2,7 @@ package repositories
 
 import (
 	"app/internal/domains"
-	"log"
+	"log/slog"
 	"strings"
 	"time"
 
@@ -95,10 +95,10 @@ func (r *imapRepository) ListenForNewEmails(senderFilter, subjectFilter string)
 			}
 		},
 		OnExpunge: func(event imap.ExpungeEvent) {
-			log.Printf("Email deleted: %d", event.MessageIndex)
+			slog.Debug("email deleted", "index", event.MessageIndex)
 		},
 		OnFetch: func(event imap.FetchEvent) {
-			log.Printf("Email fetched: UID %d", event.UID)
+			slog.Debug("email fetched", "uid", event.UID)
 		},
 	}
 
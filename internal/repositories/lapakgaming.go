@@ -2,30 +2,23 @@ package repositories
 
 import (
 	"app/internal/domains"
+	"app/internal/logging"
 	"app/internal/ports"
-	"bytes"
 	"context"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	"image"
-	"log"
 	"strings"
 	"time"
 
-	cu "github.com/Davincible/chromedp-undetected"
 	"github.com/chromedp/cdproto/target"
 	"github.com/chromedp/chromedp"
-	goqr "github.com/liyue201/goqr"
-	"github.com/patrickmn/go-cache"
 	"github.com/shopspring/decimal"
-	_ "image/jpeg"
-	_ "image/png"
 )
 
 type lapakgaming struct {
 	id            string
 	email         string
+	pool          BrowserPool
 	ctx           context.Context
 	cancelFunc    context.CancelFunc
 	signalTapOpen <-chan target.ID
@@ -33,81 +26,100 @@ type lapakgaming struct {
 
 
 
-var acceptablePrice = map[int64]bool{
-	50:   true,
-	75:   true,
-	100:  true,
-	200:  true,
-	350:  true,
-	1000: true,
-	2000: true,
+var lapakgamingCapabilities = domains.ProviderCapabilities{
+	Provider: domains.LapakGaming,
+	Methods:  []domains.PaymentMethod{domains.PromptPay},
+	Denominations: []decimal.Decimal{
+		decimal.NewFromInt(50),
+		decimal.NewFromInt(75),
+		decimal.NewFromInt(100),
+		decimal.NewFromInt(200),
+		decimal.NewFromInt(350),
+		decimal.NewFromInt(1000),
+		decimal.NewFromInt(2000),
+	},
 }
 
 var acceptablePaymentMethod = map[domains.PaymentMethod]string{
 	domains.PromptPay: "PromptPay",
 }
 
-func NewLapakGaming(email string) ports.PaymentRepository {
+// NewLapakGaming checks out as a guest, so every payment leases a tab in its
+// own browser context and shares no cookies with the others.
+func NewLapakGaming(email string, pool BrowserPool) ports.PaymentRepository {
+	pool.Register(BrowserProfile{
+		Name:     string(domains.LapakGaming),
+		Flags:    []chromedp.ExecAllocatorOption{chromedp.Flag("disable-popup-blocking", true)},
+		Isolated: true,
+	})
 	return &lapakgaming{
 		email: email,
+		pool:  pool,
 	}
 }
 
-func (l *lapakgaming) NewPayment(id string) (ports.PaymentRepository, error) {
-	ctx, cancel, err := cu.New(cu.NewConfig(
-		cu.WithChromeFlags(chromedp.Flag("disable-popup-blocking", true)),
-	))
+func (l *lapakgaming) NewPayment(ctx context.Context, id string) (ports.PaymentRepository, error) {
+	lease, err := l.pool.Lease(ctx, string(domains.LapakGaming))
 	if err != nil {
-		log.Println("Failed to create Chrome instance:", err)
+		logging.From(ctx).Error("failed to lease browser", "error", err)
 		return nil, err
 	}
-	if err := chromedp.Run(ctx,
+	browserCtx, cancel := lease.Context(), lease.Release
+	runCtx, cancelRun := bindContext(ctx, browserCtx)
+	defer cancelRun()
+	if err := runStep(runCtx, "navigate voucher",
 		chromedp.Navigate("https://www.lapakgaming.com/th-th/voucher-steam-wallet"),
 	); err != nil {
-		log.Println("Failed to navigate:", err)
+		logging.From(ctx).Error("failed to navigate", "error", err)
+		cancel()
 		return nil, err
 	}
-	signalTapOpen := chromedp.WaitNewTarget(ctx, func(info *target.Info) bool {
+	signalTapOpen := chromedp.WaitNewTarget(browserCtx, func(info *target.Info) bool {
 		// เช็คว่าเป็น popup/แท็บใหม่
 		return info.URL != "" && info.Type == "page"
 	})
 	ll := &lapakgaming{
 		id:            id,
 		email:         l.email,
-		ctx:           ctx,
+		pool:          l.pool,
+		ctx:           browserCtx,
 		cancelFunc:    cancel,
 		signalTapOpen: signalTapOpen,
 	}
-	chromdpWorker.Set(id, ll, cache.DefaultExpiration)
+	chromdpWorker.Set(id, domains.LapakGaming, ll)
 
 	return ll, nil
 }
 
-func (l *lapakgaming) SubmitPayment(id string, method domains.PaymentMethod, phone string, amount decimal.Decimal, callBackProgress func(uint)) (urlRedirect, qrData, message, orderid string, err error) {
-	if !acceptablePrice[amount.IntPart()] {
-		err = errors.New("amount not acceptable")
+func (l *lapakgaming) SubmitPayment(ctx context.Context, request domains.PaymentRequest, callBackProgress func(uint)) (result domains.PaymentResult, err error) {
+	amount := request.Amount
+	runCtx, cancel := bindContext(ctx, l.ctx)
+	defer cancel()
+	var orderid string
+	if !lapakgamingCapabilities.AcceptsAmount(amount) {
+		err = domains.ErrInvalidAmount
 		return
 	}
-	if err = chromedp.Run(l.ctx,
+	if err = runStep(runCtx, "choose product",
 		chromedp.WaitReady(fmt.Sprintf(`//p[@data-testid="lgcardproduct-product-name" and normalize-space(text())="Steam Wallet Code THB %d"]`, amount.IntPart())),
 		chromedp.Click(fmt.Sprintf(`//p[@data-testid="lgcardproduct-product-name" and normalize-space(text())="Steam Wallet Code THB %d"]`, amount.IntPart())),
 	); err != nil {
 		return 
 	}
 
-	paymentMethod, ok := acceptablePaymentMethod[method]
+	paymentMethod, ok := acceptablePaymentMethod[request.Method]
 	if !ok {
-		err = errors.New("payment method not acceptable")
+		err = domains.ErrUnsupportedMethod
 		return
 	}
-	if err = chromedp.Run(l.ctx,
+	if err = runStep(runCtx, "choose payment method",
 		chromedp.WaitReady(fmt.Sprintf(`//p[@class="text-xs ml-2 mt-1" and normalize-space(text())="%s"]`, paymentMethod)),
 		chromedp.Click(fmt.Sprintf(`//p[@class="text-xs ml-2 mt-1" and normalize-space(text())="%s"]`, paymentMethod)),
 	); err != nil {
 		return
 	}
 
-	if err = chromedp.Run(l.ctx,
+	if err = runStep(runCtx, "submit phone",
 		chromedp.Clear(`input#phoneNumber`, chromedp.ByQuery),
 		chromedp.SendKeys(`input#phoneNumber`, "999999999", chromedp.ByQuery),
 		chromedp.Clear(`input#email`, chromedp.ByQuery),
@@ -116,78 +128,96 @@ func (l *lapakgaming) SubmitPayment(id string, method domains.PaymentMethod, pho
 		chromedp.Click(`//button[@data-testid="lgpdpstickysummary-lgbuttonav-order" and normalize-space(text())="ซื้อเดี๋ยวนี้"]`),
 		chromedp.Sleep(2*time.Second), // รอให้ป๊อปอัพโหลด)
 		chromedp.WaitReady(`//button[@data-testid="lgpdpconfirmationpopup-lgbuttonav" and normalize-space(text())="ชำระเดี๋ยวนี้"]`),
+	); err != nil {
+		return
+	}
+
+	if err = runStep(runCtx, "pay now",
 		chromedp.Click(`//button[@data-testid="lgpdpconfirmationpopup-lgbuttonav" and normalize-space(text())="ชำระเดี๋ยวนี้"]`),
+	); err != nil {
+		return
+	}
+	// "ชำระเดี๋ยวนี้" places the order, so a failure from here on, even
+	// before the order id is read, must not fail over to another provider.
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("%w: %w", domains.ErrOrderPlaced, err)
+		}
+	}()
+
+	if err = runStep(runCtx, "read order id",
 		chromedp.Text(`//button[@data-testid="lgbuttoncopymv-text"]/preceding-sibling::div[1]`, &orderid, chromedp.BySearch),
 	); err != nil {
 		return
 	}
 	callBackProgress(10)
-	orderid = strings.ReplaceAll(orderid, "#", "")
+	result.OrderId = strings.ReplaceAll(orderid, "#", "")
 	select {
 	case newTarget := <-l.signalTapOpen:
 		// Attach ไปที่แท็บใหม่
 		newCtx, cancelNew := chromedp.NewContext(l.ctx, chromedp.WithTargetID(newTarget))
 		defer cancelNew()
+		qrCtx, cancelQr := bindContext(ctx, newCtx)
+		defer cancelQr()
 		callBackProgress(20)
 		// รอโหลด QR Code
 		time.Sleep(2 * time.Second) // หรือใช้ chromedp.WaitVisible ถ้ามี selector ที่แน่นอน
 		callBackProgress(30)
 		var qrBase64 string
-		err = chromedp.Run(newCtx,
+		err = runStep(qrCtx, "read qr",
 			chromedp.WaitReady(`img[alt="QR image"]`), // รอให้ QR image ปรากฏ
 			// ตัวอย่าง: ดึง text หรือ src ของ QR image
 			chromedp.AttributeValue(`img[alt="QR image"]`, "src", &qrBase64, nil),
 		)
 		if err != nil {
-			message = "Failed to retrieve QR code"
+			result.Message = "Failed to retrieve QR code"
 			return
 		}
 		callBackProgress(40)
-		base64Str := strings.TrimPrefix(qrBase64, "data:image/png;base64,")
-		base64Str = strings.TrimPrefix(base64Str, "data:image/jpeg;base64,")
-		imgBytes, decodeErr := base64.StdEncoding.DecodeString(base64Str)
-		if decodeErr != nil {
-			err = decodeErr
-			return
-		}
-		callBackProgress(45)
-		img, _, decodeErr := image.Decode(bytes.NewReader(imgBytes))
-		if decodeErr != nil {
-			err = decodeErr
-			return
-		}
-		callBackProgress(50)
-		codes, scanErr := goqr.Recognize(img)
-		if scanErr != nil {
-			err = scanErr
-			return
-		}
-		callBackProgress(55)
-		if len(codes) == 0 {
-			err = errors.New("no QR code found in image")
+		var qrData string
+		qrData, err = decodeQr(ctx, qrBase64)
+		if err != nil {
 			return
 		}
 		callBackProgress(60)
-		// use the first detected QR code payload
-		qrData = string(codes[0].Payload)
+		result.QrData = qrData
+		result.ExpiresAt = time.Now().Add(promptPayQrLifetime)
+		result.Screenshots = screenshots(qrCtx)
 		return
+	case <-ctx.Done():
+		result.Message = "Cancelled waiting for tap open signal"
+		err = ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = domains.ErrTimeout
+		}
 	case <-time.After(time.Minute):
-		message = "Timeout waiting for tap open signal"
-		err = context.DeadlineExceeded
+		result.Message = "Timeout waiting for tap open signal"
+		err = domains.ErrTimeout
 	}
 	return
 }
 
-func (l *lapakgaming) SubmitOtp(id string, otp string) (urlRedirect, qrData, message string, err error) {
-	if err := chromedp.Run(l.ctx); err != nil {
-		return "", "", "", err
+func (l *lapakgaming) SubmitOtp(ctx context.Context, id string, otp string) (domains.PaymentResult, error) {
+	runCtx, cancel := bindContext(ctx, l.ctx)
+	defer cancel()
+	if err := runStep(runCtx, "submit otp"); err != nil {
+		return domains.PaymentResult{}, err
 	}
-	return "", "", "", nil
+	return domains.PaymentResult{}, nil
+}
+
+func (l *lapakgaming) Login(ctx context.Context) error {
+	return nil
+}
+
+// LoggedIn is always true: lapakgaming checks out as a guest.
+func (l *lapakgaming) LoggedIn() bool {
+	return true
 }
 
 func (l *lapakgaming) Close() {
 	if l.cancelFunc != nil {
 		l.cancelFunc()
 	}
-	chromdpWorker.Delete(l.id)
+	chromdpWorker.Remove(l.id, l)
 }
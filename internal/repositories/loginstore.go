@@ -0,0 +1,255 @@
+package repositories
+
+import (
+	"app/internal/domains"
+	"app/internal/logging"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/storage"
+	"github.com/chromedp/chromedp"
+)
+
+// LoginState is what a browser needs to resume a provider login: its cookies
+// and the local storage of the provider's origins.
+type LoginState struct {
+	Cookies      []*network.Cookie            `json:"cookies"`
+	LocalStorage map[string]map[string]string `json:"localStorage"`
+	SavedAt      time.Time                    `json:"savedAt"`
+}
+
+// LoginStore persists LoginState per provider account.
+type LoginStore interface {
+	// Load returns the saved state of account, or nil if there is none.
+	Load(account string) (*LoginState, error)
+	Save(account string, state LoginState) error
+}
+
+type fileLoginStore struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+// NewLoginStore keeps login states in dir, one file per account, encrypted
+// with AES-GCM under a key derived from secret. An empty secret disables
+// persistence: nothing is saved and every start logs in.
+func NewLoginStore(dir string, secret string) (LoginStore, error) {
+	if secret == "" {
+		return noLoginStore{}, nil
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create login store: %w", err)
+	}
+	return &fileLoginStore{dir: dir, aead: aead}, nil
+}
+
+// path names the file after a hash of account, so emails do not end up in
+// file names.
+func (s *fileLoginStore) path(account string) string {
+	sum := sha256.Sum256([]byte(account))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:16])+".session")
+}
+
+func (s *fileLoginStore) Load(account string) (*LoginState, error) {
+	data, err := os.ReadFile(s.path(account))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	size := s.aead.NonceSize()
+	if len(data) < size {
+		return nil, errors.New("login state file is truncated")
+	}
+	plain, err := s.aead.Open(nil, data[:size], data[size:], []byte(account))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt login state: %w", err)
+	}
+	var state LoginState
+	if err := json.Unmarshal(plain, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (s *fileLoginStore) Save(account string, state LoginState) error {
+	plain, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data := s.aead.Seal(nonce, nonce, plain, []byte(account))
+	path := s.path(account)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type noLoginStore struct{}
+
+func (noLoginStore) Load(string) (*LoginState, error) {
+	return nil, nil
+}
+
+func (noLoginStore) Save(string, LoginState) error {
+	return nil
+}
+
+// accountLogin logs a browser in to one provider account, restoring the
+// saved login when the provider still accepts it.
+type accountLogin struct {
+	store    LoginStore
+	provider domains.PaymentProvider
+	account  string
+	// origins are the pages whose local storage belongs to the login.
+	origins []string
+	// checkURL is a page that redirects to a URL containing loginMarker when
+	// the browser is logged out.
+	checkURL    string
+	loginMarker string
+	login       func() chromedp.Tasks
+}
+
+// establish restores the saved login and falls back to a full login when
+// there is none or the provider rejects it, saving the new one.
+func (a accountLogin) establish(ctx context.Context) error {
+	logger := logging.From(ctx)
+	restored, err := a.restore(ctx)
+	if err != nil {
+		logger.Warn("failed to restore saved login", logging.KeyProvider, a.provider, "error", err)
+	}
+	if restored {
+		logger.Info("restored saved login", logging.KeyProvider, a.provider)
+		return nil
+	}
+	return a.full(ctx)
+}
+
+// full runs the login form and saves the resulting session.
+func (a accountLogin) full(ctx context.Context) error {
+	if err := runTraced(ctx, "login", a.login()); err != nil {
+		return err
+	}
+	if err := a.save(ctx); err != nil {
+		logging.From(ctx).Warn("failed to save login", logging.KeyProvider, a.provider, "error", err)
+	}
+	return nil
+}
+
+func (a accountLogin) restore(ctx context.Context) (bool, error) {
+	state, err := a.store.Load(a.account)
+	if err != nil || state == nil {
+		return false, err
+	}
+	now := time.Now()
+	cookies := make([]*network.CookieParam, 0, len(state.Cookies))
+	for _, c := range state.Cookies {
+		param := &network.CookieParam{
+			Name:         c.Name,
+			Value:        c.Value,
+			Domain:       c.Domain,
+			Path:         c.Path,
+			Secure:       c.Secure,
+			HTTPOnly:     c.HTTPOnly,
+			SameSite:     c.SameSite,
+			Priority:     c.Priority,
+			SourceScheme: c.SourceScheme,
+			SourcePort:   c.SourcePort,
+			PartitionKey: c.PartitionKey,
+		}
+		if !c.Session {
+			expires := time.Unix(int64(c.Expires), 0)
+			if expires.Before(now) {
+				continue
+			}
+			since := cdp.TimeSinceEpoch(expires)
+			param.Expires = &since
+		}
+		cookies = append(cookies, param)
+	}
+	actions := chromedp.Tasks{storage.SetCookies(cookies)}
+	for _, origin := range a.origins {
+		items := state.LocalStorage[origin]
+		if len(items) == 0 {
+			continue
+		}
+		encoded, err := json.Marshal(items)
+		if err != nil {
+			return false, err
+		}
+		actions = append(actions,
+			chromedp.Navigate(origin),
+			chromedp.Evaluate(fmt.Sprintf(`for (const [k, v] of Object.entries(%s)) localStorage.setItem(k, v)`, encoded), nil),
+		)
+	}
+	if err := runTraced(ctx, "restore login", actions); err != nil {
+		return false, err
+	}
+	return a.check(ctx)
+}
+
+// check reports whether the browser is logged in.
+func (a accountLogin) check(ctx context.Context) (bool, error) {
+	var currentURL string
+	if err := runTraced(ctx, "check login",
+		chromedp.Navigate(a.checkURL),
+		chromedp.Location(&currentURL),
+	); err != nil {
+		return false, err
+	}
+	return !strings.Contains(currentURL, a.loginMarker), nil
+}
+
+func (a accountLogin) save(ctx context.Context) error {
+	state := LoginState{LocalStorage: map[string]map[string]string{}, SavedAt: time.Now()}
+	actions := chromedp.Tasks{chromedp.ActionFunc(func(ctx context.Context) error {
+		cookies, err := storage.GetCookies().Do(ctx)
+		state.Cookies = cookies
+		return err
+	})}
+	for _, origin := range a.origins {
+		items := map[string]string{}
+		state.LocalStorage[origin] = items
+		actions = append(actions,
+			chromedp.Navigate(origin),
+			chromedp.Evaluate(`Object.assign({}, localStorage)`, &items),
+		)
+	}
+	if err := runTraced(ctx, "save login", actions); err != nil {
+		return err
+	}
+	if err := a.store.Save(a.account, state); err != nil {
+		return err
+	}
+	logging.From(ctx).Debug("saved login", logging.KeyProvider, a.provider, "cookies", len(state.Cookies))
+	return nil
+}
@@ -0,0 +1,92 @@
+package repositories
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+)
+
+func TestFileLoginStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLoginStore(dir, "secret")
+	if err != nil {
+		t.Fatalf("NewLoginStore() = %v", err)
+	}
+	const account = "seagm:someone@example.com"
+
+	if state, err := store.Load(account); state != nil || err != nil {
+		t.Fatalf("Load() before Save = %v, %v, want nil, nil", state, err)
+	}
+
+	saved := LoginState{
+		Cookies: []*network.Cookie{{
+			Name:         "session",
+			Value:        "cookie-value",
+			Domain:       ".seagm.com",
+			Priority:     network.CookiePriorityMedium,
+			SourceScheme: network.CookieSourceSchemeSecure,
+		}},
+		LocalStorage: map[string]map[string]string{"https://www.seagm.com": {"token": "local-value"}},
+		SavedAt:      time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if err := store.Save(account, saved); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	loaded, err := store.Load(account)
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	if len(loaded.Cookies) != 1 || loaded.Cookies[0].Value != "cookie-value" ||
+		loaded.LocalStorage["https://www.seagm.com"]["token"] != "local-value" ||
+		!loaded.SavedAt.Equal(saved.SavedAt) {
+		t.Fatalf("Load() = %+v, want %+v", loaded, saved)
+	}
+
+	path := store.(*fileLoginStore).path(account)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() = %v", err)
+	}
+	for _, secret := range []string{"cookie-value", "local-value", "someone@example.com"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Fatalf("login state file contains %q in the clear", secret)
+		}
+	}
+
+	// A state copied to another account's file must not be accepted.
+	const other = "seagm:other@example.com"
+	if err := os.WriteFile(store.(*fileLoginStore).path(other), data, 0o600); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	if _, err := store.Load(other); err == nil {
+		t.Fatal("Load() of another account's state succeeded")
+	}
+
+	rotated, err := NewLoginStore(dir, "another secret")
+	if err != nil {
+		t.Fatalf("NewLoginStore() = %v", err)
+	}
+	if _, err := rotated.Load(account); err == nil {
+		t.Fatal("Load() under another secret succeeded")
+	}
+}
+
+func TestNoLoginStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLoginStore(dir, "")
+	if err != nil {
+		t.Fatalf("NewLoginStore() = %v", err)
+	}
+	if err := store.Save("seagm:someone@example.com", LoginState{SavedAt: time.Now()}); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	if state, err := store.Load("seagm:someone@example.com"); state != nil || err != nil {
+		t.Fatalf("Load() = %v, %v, want nil, nil", state, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("store without a secret wrote %d files", len(entries))
+	}
+}
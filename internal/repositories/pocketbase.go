@@ -2,37 +2,54 @@ package repositories
 
 import (
 	"app/internal/domains"
+	"app/internal/metrics"
+	"app/internal/tracing"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/robfig/cron"
+	"go.opentelemetry.io/otel/attribute"
 	"resty.dev/v3"
 )
 
+var ErrRecordNotFound = errors.New("record not found")
+
+// DateTimeLayout is the layout PocketBase uses for datetime fields and filters.
+const DateTimeLayout = "2006-01-02 15:04:05.000Z"
+
 type pocketBase struct {
 	address   string
-	isReady   bool
+	isReady   atomic.Bool
 	client    *resty.Client
 	cronjob   *cron.Cron
 	superuser domains.SuperUserRecord
 }
 
 type PocketBase interface {
-	Subscribe(collection string, T domains.PaymentRecord) (domains.Listening, domains.StopListening, chan domains.RecordHook[domains.PaymentRecord], chan error)
 	IsReady() bool
 	Close()
-	UpdateRecord(collection string, id string, record map[string]any) error
-	GetPaymentRecordByFilter(collection string, filter string) ([]domains.PaymentRecord, error)
-	GetPaymentRecordById(collection string, id string, T domains.PaymentRecord) (domains.PaymentRecord, error)
-	CreateRecord(collection string, record map[string]any) (domains.CreateRecordResponse, error)
 	GetSuperUser() domains.SuperUserRecord
-	GetRequestTimeForFreePostFilter(collection string, filter string) ([]domains.RequestTimeForFreePostRecord, error)
-	DeleteRecord(collection string, id string) error
-	GetPostById(collection string, id string) (domains.PostRecord, error)
-	 GetPostRecordByFilter(collection string, filter string) ([]domains.PostRecord, error)
-	GetFileFromObjectKey(collection string, id string, objectKey string) (io.Reader, error)
-	AddFile(collection string, id string, fieldName string, file ...io.Reader) error
+	CreateRecord(ctx context.Context, collection string, record map[string]any) (domains.CreateRecordResponse, error)
+	UpdateRecord(ctx context.Context, collection string, id string, record map[string]any) error
+	DeleteRecord(ctx context.Context, collection string, id string) error
+	GetFileFromObjectKey(ctx context.Context, collection string, id string, objectKey string) (io.Reader, error)
+	AddFile(ctx context.Context, collection string, id string, fieldName string, file ...io.Reader) error
+	Batch(ctx context.Context, requests []domains.BatchRequest) ([]domains.BatchResponse, error)
+	// BatchEnabled reports whether /api/batch is enabled in the settings.
+	BatchEnabled(ctx context.Context) (bool, error)
+	// Indexes returns the CREATE INDEX statements of collection.
+	Indexes(ctx context.Context, collection string) ([]string, error)
+
+	// Send and Subscribe back the generic helpers in records.go; they are
+	// exported so other packages can fake the client in tests.
+	Send(ctx context.Context, method string, path string, query map[string]string, body any, result any) error
+	Subscribe(collection string, event any, onEvent func(any), onConnect func()) (domains.Listening, domains.StopListening, chan error)
 }
 
 func NewPocketBase(address, username, password string) PocketBase {
@@ -59,56 +76,60 @@ func NewPocketBase(address, username, password string) PocketBase {
 	cronjob := cron.New()
 	p := &pocketBase{
 		address:   address,
-		isReady:   true,
 		client:    client,
 		cronjob:   cronjob,
 		superuser: authResponse.Record,
 	}
+	p.isReady.Store(true)
 	cronjob.AddFunc("@hourly", func() {
 		reAuthResponse := domains.AuthResponse{}
 		reAuthResp, err := p.client.R().SetResult(&reAuthResponse).Post("/api/collections/_superusers/auth-refresh")
 		if err != nil {
-			log.Print("Error re-authenticating:", err)
-			p.isReady = false
+			slog.Error("failed to re-authenticate with PocketBase", "error", err)
+			metrics.Reauthentications.WithLabelValues("pocketbase", metrics.ResultError).Inc()
+			p.isReady.Store(false)
 			return
 		}
 		if reAuthResp.IsError() {
-			log.Print("Error re-authenticating:", reAuthResp.Error())
-			p.isReady = false
+			slog.Error("failed to re-authenticate with PocketBase", "status", reAuthResp.StatusCode())
+			metrics.Reauthentications.WithLabelValues("pocketbase", metrics.ResultError).Inc()
+			p.isReady.Store(false)
 			return
 		}
 		if reAuthResponse.Token == "" {
-			log.Print("Empty token on re-authentication")
-			p.isReady = false
+			slog.Error("empty token on PocketBase re-authentication")
+			metrics.Reauthentications.WithLabelValues("pocketbase", metrics.ResultError).Inc()
+			p.isReady.Store(false)
 			return
 		}
+		metrics.Reauthentications.WithLabelValues("pocketbase", metrics.ResultSuccess).Inc()
+		p.isReady.Store(true)
 		p.client.SetAuthToken(reAuthResponse.Token)
 		p.superuser = reAuthResponse.Record
-		log.Print("Re-authenticated successfully")
+		slog.Info("re-authenticated with PocketBase")
 	})
 	cronjob.Start()
 	return p
 }
 
-type CallbackFunc[T any] func(domains.RecordHook[T]) error
-
-func (p *pocketBase) Subscribe(collection string, T domains.PaymentRecord) (domains.Listening, domains.StopListening, chan domains.RecordHook[domains.PaymentRecord], chan error) {
+// Subscribe opens the realtime stream. PocketBase sends PB_CONNECT on every
+// (re)connection with a new client id, so the collection subscription is
+// renewed there and onConnect is called once it is in place.
+func (p *pocketBase) Subscribe(collection string, event any, onEvent func(any), onConnect func()) (domains.Listening, domains.StopListening, chan error) {
 	errChan := make(chan error, 1)
-	recordChan := make(chan domains.RecordHook[domains.PaymentRecord], 1)
 	eventSource := resty.NewEventSource()
 	eventSource.OnOpen(func(url string) {
-		fmt.Println("I'm connected:", url)
+		slog.Info("realtime stream connected", "collection", collection)
 	})
 	eventSource.SetURL(p.address+"api/realtime").
 		OnError(func(err error) {
-			fmt.Println("Error occurred:", err)
+			slog.Warn("realtime stream error", "collection", collection, "error", err)
 		}).
 		AddHeader("Authorization", p.client.AuthToken()).
 		AddEventListener(collection, func(a any) {
-			evt := a.(*domains.RecordHook[domains.PaymentRecord])
-			log.Printf("Received event for collection %s: %+v", collection, evt)
-			recordChan <- *evt
-		}, domains.RecordHook[domains.PaymentRecord]{}).
+			slog.Debug("realtime event received", "collection", collection)
+			onEvent(a)
+		}, event).
 		AddEventListener("PB_CONNECT", func(a any) {
 			evt := a.(*resty.Event)
 			resp, err := p.client.R().SetFormData(map[string]string{
@@ -116,14 +137,23 @@ func (p *pocketBase) Subscribe(collection string, T domains.PaymentRecord) (doma
 				"subscriptions": collection,
 			}).Post("api/realtime")
 			if err != nil {
-				log.Print("Error subscribing to collection:", err)
-				errChan <- err
+				slog.Error("failed to subscribe to collection", "collection", collection, "error", err)
+				select {
+				case errChan <- err:
+				default:
+				}
+				return
 			}
 			if resp.IsError() {
-				log.Print("Error subscribing to collection:", resp.String())
-				errChan <- fmt.Errorf("error subscribing to collection: %s", resp.String())
+				slog.Error("failed to subscribe to collection", "collection", collection, "status", resp.StatusCode())
+				select {
+				case errChan <- fmt.Errorf("error subscribing to collection: %s", resp.String()):
+				default:
+				}
+				return
 			}
-			log.Printf("Subscribed to collection %s successfully status %d", collection, resp.StatusCode())
+			slog.Info("subscribed to collection", "collection", collection)
+			onConnect()
 		}, nil)
 
 	listeningFunc := func() error {
@@ -134,70 +164,62 @@ func (p *pocketBase) Subscribe(collection string, T domains.PaymentRecord) (doma
 		eventSource.Close()
 	}
 
-	return listeningFunc, stopListening, recordChan, errChan
+	return listeningFunc, stopListening, errChan
 }
 
+// IsReady reports whether the superuser token is valid. It turns false when
+// a refresh fails and true again after the next successful one.
 func (p *pocketBase) IsReady() bool {
-	return p.isReady
+	return p.isReady.Load()
 }
 
 func (p *pocketBase) Close() {
-	p.isReady = false
+	p.cronjob.Stop()
+	p.isReady.Store(false)
 }
 
-func (p *pocketBase) UpdateRecord(collection string, id string, record map[string]any) error {
-	_, err := p.client.R().
-		SetBody(record).
-		Patch("/api/collections/" + collection + "/records/" + id)
-	return err
-}
-
-func (p *pocketBase) GetPaymentRecordByFilter(collection string, filter string) ([]domains.PaymentRecord, error) {
-	response := domains.ListRecordsResponse[domains.PaymentRecord]{}
-	resp, err := p.client.R().
-		SetQueryParams(map[string]string{
-			"filter": filter,
-			"limit":  "1",
-		}).
-		SetResult(&response).
-		Get("/api/collections/" + collection + "/records")
+// Send performs one REST call against the PocketBase API. A 404 is reported
+// as ErrRecordNotFound and any other error status as an error.
+func (p *pocketBase) Send(ctx context.Context, method string, path string, query map[string]string, body any, result any) (err error) {
+	ctx, span := tracing.Start(ctx, "pocketbase "+method,
+		attribute.String("http.request.method", method),
+		attribute.String("url.path", path),
+	)
+	defer func() { tracing.End(span, err) }()
+	r := p.client.R().SetContext(ctx).SetQueryParams(query)
+	if body != nil {
+		r.SetBody(body)
+	}
+	if result != nil {
+		r.SetResult(result)
+	}
+	resp, err := r.Execute(method, path)
 	if err != nil {
-		return nil, err
+		countRequestError(method, nil)
+		return err
 	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode()))
 	if resp.IsError() {
-		return nil, fmt.Errorf("error fetching record: %s", resp.String())
+		countRequestError(method, resp)
 	}
-	if len(response.Items) == 0 {
-		return nil, fmt.Errorf("record not found with filter: %s", filter)
-	}
-	return response.Items, nil
-}
-func (p *pocketBase) GetPaymentRecordById(collection string, id string, T domains.PaymentRecord) (domains.PaymentRecord, error) {
-	response := domains.PaymentRecord(T)
-	resp, err := p.client.R().
-		SetResult(&response).
-		Get("/api/collections/" + collection + "/records/" + id)
-	if err != nil {
-		return domains.PaymentRecord{}, err
+	if resp.StatusCode() == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrRecordNotFound, path)
 	}
 	if resp.IsError() {
-		return domains.PaymentRecord{}, fmt.Errorf("error fetching record by id: %s", resp.String())
+		return fmt.Errorf("error on %s %s: %s", method, path, resp.String())
 	}
-	return response, nil
+	return nil
+}
+
+func (p *pocketBase) UpdateRecord(ctx context.Context, collection string, id string, record map[string]any) error {
+	return p.Send(ctx, http.MethodPatch, recordPath(collection, id), nil, record, nil)
 }
 
-func (p *pocketBase) CreateRecord(collection string, record map[string]any) (domains.CreateRecordResponse, error) {
+func (p *pocketBase) CreateRecord(ctx context.Context, collection string, record map[string]any) (domains.CreateRecordResponse, error) {
 	response := domains.CreateRecordResponse{}
-	resp, err := p.client.R().
-		SetBody(record).
-		SetResult(&response).
-		Post("/api/collections/" + collection + "/records")
-	if err != nil {
+	if err := p.Send(ctx, http.MethodPost, recordsPath(collection), nil, record, &response); err != nil {
 		return domains.CreateRecordResponse{}, err
 	}
-	if resp.IsError() {
-		return domains.CreateRecordResponse{}, fmt.Errorf("error creating record: %s", resp.String())
-	}
 	return response, nil
 }
 
@@ -205,96 +227,95 @@ func (p *pocketBase) GetSuperUser() domains.SuperUserRecord {
 	return p.superuser
 }
 
-func (p *pocketBase) GetRequestTimeForFreePostFilter(collection string, filter string) ([]domains.RequestTimeForFreePostRecord, error) {
-	response := domains.ListRecordsResponse[domains.RequestTimeForFreePostRecord]{}
-	resp, err := p.client.R().
-		SetQueryParams(map[string]string{
-			"filter": filter,
-			"limit":  "20",
-		}).
-		SetResult(&response).
-		Get("/api/collections/" + collection + "/records")
-	if err != nil {
-		return nil, err
-	}
-	if resp.IsError() {
-		return nil, fmt.Errorf("error fetching record: %s", resp.String())
-	}
-	if len(response.Items) == 0 {
-		return nil, fmt.Errorf("record not found with filter: %s", filter)
-	}
-	return response.Items, nil
-}
-
-func (p *pocketBase) DeleteRecord(collection string, id string) error {
-	_, err := p.client.R().
-		Delete("/api/collections/" + collection + "/records/" + id)
-	return err
+func (p *pocketBase) DeleteRecord(ctx context.Context, collection string, id string) error {
+	return p.Send(ctx, http.MethodDelete, recordPath(collection, id), nil, nil, nil)
 }
 
-func (p *pocketBase) GetPostById(collection string, id string) (domains.PostRecord, error) {
-	response := domains.PostRecord{}
-	resp, err := p.client.R().
-		SetQueryParams(map[string]string{
-			"filter": fmt.Sprintf("id='%s'", id),
-			"limit":  "1",
-		}).
-		SetResult(&response).
-		Get("/api/collections/" + collection + "/records")
-	if err != nil {
-		return domains.PostRecord{}, err
-	}
-	if resp.IsError() {
-		return domains.PostRecord{}, fmt.Errorf("error fetching record by id: %s", resp.String())
-	}
-	return response, nil
-}
-
-func (p *pocketBase) GetFileFromObjectKey(collection string, id string, objectKey string) (io.Reader, error) {
+func (p *pocketBase) GetFileFromObjectKey(ctx context.Context, collection string, id string, objectKey string) (_ io.Reader, err error) {
+	path := fmt.Sprintf("/api/files/%s/%s/%s", collection, id, objectKey)
+	ctx, span := tracing.Start(ctx, "pocketbase GET file", attribute.String("url.path", path))
+	defer func() { tracing.End(span, err) }()
 	resp, err := p.client.R().
+		SetContext(ctx).
 		SetDoNotParseResponse(true).
-		Get(fmt.Sprintf("/api/files/%s/%s/%s", collection, id, objectKey))
+		Get(path)
 	if err != nil {
+		countRequestError(http.MethodGet, nil)
 		return nil, err
 	}
 	if resp.IsError() {
+		countRequestError(http.MethodGet, resp)
 		return nil, fmt.Errorf("error fetching file from url: %s", resp.String())
 	}
 	return resp.Body, nil
 }
 
-func (p *pocketBase) AddFile(collection string, id string, fieldName string, file ...io.Reader) error {
-	r := p.client.R()
+func (p *pocketBase) AddFile(ctx context.Context, collection string, id string, fieldName string, file ...io.Reader) (err error) {
+	ctx, span := tracing.Start(ctx, "pocketbase PATCH file", attribute.String("url.path", recordPath(collection, id)))
+	defer func() { tracing.End(span, err) }()
+	r := p.client.R().SetContext(ctx)
 	for _, f := range file {
 		r.SetFileReader(fieldName, "file", f)
 	}
-	resp, err := r.Patch("/api/collections/" + collection + "/records/" + id)
+	resp, err := r.Patch(recordPath(collection, id))
 	if err != nil {
+		countRequestError(http.MethodPatch, nil)
 		return err
 	}
 	if resp.IsError() {
+		countRequestError(http.MethodPatch, resp)
 		return fmt.Errorf("error updating file: %s", resp.String())
 	}
 	return nil
 }
 
-func (p *pocketBase) GetPostRecordByFilter(collection string, filter string) ([]domains.PostRecord, error) {
-	response := domains.ListRecordsResponse[domains.PostRecord]{}
-	resp, err := p.client.R().
-		SetQueryParams(map[string]string{
-			"filter": filter,
-			"limit":  "20",
-		}).
-		SetResult(&response).
-		Get("/api/collections/" + collection + "/records")
-	if err != nil {
+// Batch applies requests in a single transaction through /api/batch; either
+// all of them are applied or none are. Batch requests must be enabled in the
+// PocketBase settings.
+func (p *pocketBase) Batch(ctx context.Context, requests []domains.BatchRequest) ([]domains.BatchResponse, error) {
+	response := []domains.BatchResponse{}
+	if err := p.Send(ctx, http.MethodPost, "/api/batch", nil, map[string]any{"requests": requests}, &response); err != nil {
 		return nil, err
 	}
-	if resp.IsError() {
-		return nil, fmt.Errorf("error fetching record: %s", resp.String())
+	return response, nil
+}
+
+func (p *pocketBase) BatchEnabled(ctx context.Context) (bool, error) {
+	settings := struct {
+		Batch struct {
+			Enabled bool `json:"enabled"`
+		} `json:"batch"`
+	}{}
+	if err := p.Send(ctx, http.MethodGet, "/api/settings", map[string]string{"fields": "batch"}, nil, &settings); err != nil {
+		return false, err
 	}
-	if len(response.Items) == 0 {
-		return nil, fmt.Errorf("record not found with filter: %s", filter)
+	return settings.Batch.Enabled, nil
+}
+
+func (p *pocketBase) Indexes(ctx context.Context, collection string) ([]string, error) {
+	schema := struct {
+		Indexes []string `json:"indexes"`
+	}{}
+	if err := p.Send(ctx, http.MethodGet, "/api/collections/"+collection, nil, nil, &schema); err != nil {
+		return nil, err
 	}
-	return response.Items, nil
+	return schema.Indexes, nil
+}
+
+// countRequestError records a failed request; resp is nil when the request
+// never got a response.
+func countRequestError(method string, resp *resty.Response) {
+	status := "transport"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode())
+	}
+	metrics.PocketBaseErrors.WithLabelValues(method, status).Inc()
+}
+
+func recordsPath(collection string) string {
+	return "/api/collections/" + collection + "/records"
+}
+
+func recordPath(collection string, id string) string {
+	return recordsPath(collection) + "/" + id
 }
@@ -0,0 +1,111 @@
+package repositories
+
+import (
+	"app/internal/domains"
+	"context"
+	"iter"
+	"net/http"
+	"strconv"
+)
+
+// listPerPage is the page size used when walking every page of a list.
+const listPerPage = 200
+
+type Query struct {
+	Filter Filter
+	Sort   Sort
+}
+
+func (q Query) params() map[string]string {
+	params := map[string]string{}
+	if !q.Filter.IsZero() {
+		params["filter"] = q.Filter.String()
+	}
+	if q.Sort.String() != "" {
+		params["sort"] = q.Sort.String()
+	}
+	return params
+}
+
+type CallbackFunc[T any] func(domains.RecordHook[T]) error
+
+func Get[T any](ctx context.Context, pb PocketBase, collection string, id string) (T, error) {
+	var record T
+	if err := pb.Send(ctx, http.MethodGet, recordPath(collection, id), nil, nil, &record); err != nil {
+		var zero T
+		return zero, err
+	}
+	return record, nil
+}
+
+func ListPage[T any](ctx context.Context, pb PocketBase, collection string, query Query, page int, perPage int) (domains.ListRecordsResponse[T], error) {
+	params := query.params()
+	params["page"] = strconv.Itoa(page)
+	params["perPage"] = strconv.Itoa(perPage)
+	response := domains.ListRecordsResponse[T]{}
+	if err := pb.Send(ctx, http.MethodGet, recordsPath(collection), params, nil, &response); err != nil {
+		return domains.ListRecordsResponse[T]{}, err
+	}
+	return response, nil
+}
+
+// Iterate streams every record matching query, fetching the next page only
+// once the previous one has been consumed.
+func Iterate[T any](ctx context.Context, pb PocketBase, collection string, query Query) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for page := 1; ; page++ {
+			response, err := ListPage[T](ctx, pb, collection, query, page, listPerPage)
+			if err != nil {
+				var zero T
+				yield(zero, err)
+				return
+			}
+			for _, item := range response.Items {
+				if !yield(item, nil) {
+					return
+				}
+			}
+			if page >= response.TotalPages {
+				return
+			}
+		}
+	}
+}
+
+// List collects every page of records matching query.
+func List[T any](ctx context.Context, pb PocketBase, collection string, query Query) ([]T, error) {
+	items := []T{}
+	for item, err := range Iterate[T](ctx, pb, collection, query) {
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Subscribe listens for realtime events on collection and decodes each
+// record as T. Events that arrive once ctx is done are dropped, so the
+// stream is never left blocked on a reader that went away.
+func Subscribe[T any](ctx context.Context, pb PocketBase, collection string) domains.Subscription[T] {
+	recordChan := make(chan domains.RecordHook[T], 1)
+	connectedChan := make(chan struct{}, 1)
+	start, stop, errChan := pb.Subscribe(collection, domains.RecordHook[T]{}, func(a any) {
+		select {
+		case recordChan <- *a.(*domains.RecordHook[T]):
+		case <-ctx.Done():
+		}
+	}, func() {
+		select {
+		case connectedChan <- struct{}{}:
+		default:
+		}
+	})
+	return domains.Subscription[T]{
+		Start:     start,
+		Stop:      stop,
+		Records:   recordChan,
+		Connected: connectedChan,
+		Errors:    errChan,
+	}
+}
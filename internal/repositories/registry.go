@@ -0,0 +1,229 @@
+package repositories
+
+import (
+	"app/config"
+	"app/internal/domains"
+	"app/internal/ports"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/shopspring/decimal"
+)
+
+type ProviderFactory func() ports.PaymentRepository
+
+type PaymentRegistry interface {
+	Register(name domains.PaymentProvider, factory ProviderFactory, capabilities domains.ProviderCapabilities)
+	Get(name domains.PaymentProvider) (ports.PaymentRepository, error)
+	Default() domains.PaymentProvider
+	Order(preferred domains.PaymentProvider) []domains.PaymentProvider
+	Route(preferred domains.PaymentProvider, method domains.PaymentMethod, amount decimal.Decimal) ([]domains.PaymentProvider, error)
+	// Capabilities lists the capabilities given to Register, the only
+	// place a provider's capabilities are declared.
+	Capabilities() []domains.ProviderCapabilities
+	CapabilitiesOf(name domains.PaymentProvider) (domains.ProviderCapabilities, bool)
+	Names() []domains.PaymentProvider
+	// LoginState reports LoggedIn for every provider started so far.
+	LoginState() map[domains.PaymentProvider]bool
+	Close()
+}
+
+type paymentRegistry struct {
+	mu          sync.Mutex
+	defaultName domains.PaymentProvider
+	failover    []domains.PaymentProvider
+	factories   map[domains.PaymentProvider]ProviderFactory
+	caps        map[domains.PaymentProvider]domains.ProviderCapabilities
+	instances   map[domains.PaymentProvider]ports.PaymentRepository
+	starting    map[domains.PaymentProvider]*providerStart
+}
+
+// providerStart is a provider being built by Get; concurrent Gets for the
+// same provider wait on done instead of building it twice.
+type providerStart struct {
+	done chan struct{}
+	repo ports.PaymentRepository
+	err  error
+}
+
+func NewPaymentRegistry(defaultName domains.PaymentProvider, failover ...domains.PaymentProvider) PaymentRegistry {
+	return &paymentRegistry{
+		defaultName: defaultName,
+		failover:    failover,
+		factories:   map[domains.PaymentProvider]ProviderFactory{},
+		caps:        map[domains.PaymentProvider]domains.ProviderCapabilities{},
+		instances:   map[domains.PaymentProvider]ports.PaymentRepository{},
+		starting:    map[domains.PaymentProvider]*providerStart{},
+	}
+}
+
+// NewPaymentRegistryFromConfig registers every provider that has credentials
+// configured. Providers are started lazily on first Get, lease their
+// browsers from pool and keep their logins in logins.
+func NewPaymentRegistryFromConfig(cfg config.PaymentConfig, pool BrowserPool, logins LoginStore) PaymentRegistry {
+	failover := make([]domains.PaymentProvider, 0, len(cfg.Failover))
+	for _, name := range cfg.Failover {
+		failover = append(failover, domains.PaymentProvider(strings.TrimSpace(name)))
+	}
+	r := NewPaymentRegistry(domains.PaymentProvider(cfg.Provider), failover...)
+	if cfg.Seagm.Email != "" {
+		r.Register(domains.Seagm, func() ports.PaymentRepository {
+			return NewSeagm(cfg.Seagm.Email, cfg.Seagm.Password, pool, logins)
+		}, seagmCapabilities)
+	}
+	if cfg.LapakGaming.Email != "" {
+		r.Register(domains.LapakGaming, func() ports.PaymentRepository {
+			return NewLapakGaming(cfg.LapakGaming.Email, pool)
+		}, lapakgamingCapabilities)
+	}
+	if cfg.Ggkeystore.Email != "" {
+		r.Register(domains.Ggkeystore, func() ports.PaymentRepository {
+			return NewGgkeystore(cfg.Ggkeystore.Email, cfg.Ggkeystore.Password, pool, logins)
+		}, ggkeystoreCapabilities)
+	}
+	return r
+}
+
+func (r *paymentRegistry) Register(name domains.PaymentProvider, factory ProviderFactory, capabilities domains.ProviderCapabilities) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.factories[name] = factory
+	r.caps[name] = capabilities
+}
+
+func (r *paymentRegistry) Get(name domains.PaymentProvider) (ports.PaymentRepository, error) {
+	if name == "" {
+		name = r.defaultName
+	}
+	r.mu.Lock()
+	if repo, ok := r.instances[name]; ok {
+		r.mu.Unlock()
+		return repo, nil
+	}
+	factory, ok := r.factories[name]
+	if !ok {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("payment provider %q is not configured", name)
+	}
+	if start, ok := r.starting[name]; ok {
+		r.mu.Unlock()
+		<-start.done
+		return start.repo, start.err
+	}
+	start := &providerStart{done: make(chan struct{})}
+	r.starting[name] = start
+	r.mu.Unlock()
+
+	// Factories log in and wait for a browser, so they run without the lock
+	// to keep other providers available meanwhile.
+	repo := factory()
+
+	r.mu.Lock()
+	delete(r.starting, name)
+	if repo == nil {
+		start.err = fmt.Errorf("failed to start payment provider %q", name)
+	} else {
+		r.instances[name] = repo
+		start.repo = repo
+	}
+	r.mu.Unlock()
+	close(start.done)
+	return start.repo, start.err
+}
+
+func (r *paymentRegistry) Default() domains.PaymentProvider {
+	return r.defaultName
+}
+
+// Order returns the providers to try for a payment: the preferred one, then
+// the default, then the configured failover list, without duplicates.
+func (r *paymentRegistry) Order(preferred domains.PaymentProvider) []domains.PaymentProvider {
+	seen := map[domains.PaymentProvider]bool{}
+	order := []domains.PaymentProvider{}
+	for _, name := range append([]domains.PaymentProvider{preferred, r.defaultName}, r.failover...) {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		order = append(order, name)
+	}
+	return order
+}
+
+// Route narrows Order down to the configured providers whose capabilities
+// accept method and amount, so a payment no provider can take is refused
+// before any browser is started.
+func (r *paymentRegistry) Route(preferred domains.PaymentProvider, method domains.PaymentMethod, amount decimal.Decimal) ([]domains.PaymentProvider, error) {
+	order := r.Order(preferred)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	routed := []domains.PaymentProvider{}
+	methodSupported := false
+	for _, name := range order {
+		caps, ok := r.caps[name]
+		if !ok || !caps.SupportsMethod(method) {
+			continue
+		}
+		methodSupported = true
+		if caps.AcceptsAmount(amount) {
+			routed = append(routed, name)
+		}
+	}
+	if !methodSupported {
+		return nil, fmt.Errorf("%w: %s is not supported by any payment provider", domains.ErrUnsupportedMethod, method)
+	}
+	if len(routed) == 0 {
+		return nil, fmt.Errorf("%w: %s is not accepted by any payment provider", domains.ErrInvalidAmount, amount.String())
+	}
+	return routed, nil
+}
+
+func (r *paymentRegistry) Capabilities() []domains.ProviderCapabilities {
+	names := r.Names()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	caps := make([]domains.ProviderCapabilities, 0, len(names))
+	for _, name := range names {
+		caps = append(caps, r.caps[name])
+	}
+	return caps
+}
+
+func (r *paymentRegistry) CapabilitiesOf(name domains.PaymentProvider) (domains.ProviderCapabilities, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	caps, ok := r.caps[name]
+	return caps, ok
+}
+
+func (r *paymentRegistry) Names() []domains.PaymentProvider {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]domains.PaymentProvider, 0, len(r.factories))
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+func (r *paymentRegistry) LoginState() map[domains.PaymentProvider]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state := make(map[domains.PaymentProvider]bool, len(r.instances))
+	for name, repo := range r.instances {
+		state[name] = repo.LoggedIn()
+	}
+	return state
+}
+
+func (r *paymentRegistry) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, repo := range r.instances {
+		repo.Close()
+		delete(r.instances, name)
+	}
+}
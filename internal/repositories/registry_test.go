@@ -0,0 +1,61 @@
+package repositories
+
+import (
+	"app/internal/domains"
+	"app/internal/ports"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestRoute(t *testing.T) {
+	d := decimal.RequireFromString
+	r := NewPaymentRegistry(domains.Seagm, domains.Ggkeystore, domains.LapakGaming)
+	none := func() ports.PaymentRepository { return nil }
+	r.Register(domains.Seagm, none, domains.ProviderCapabilities{
+		Provider:  domains.Seagm,
+		Methods:   []domains.PaymentMethod{domains.PromptPay},
+		MinAmount: d("10"),
+		MaxAmount: d("1000"),
+	})
+	r.Register(domains.Ggkeystore, none, domains.ProviderCapabilities{
+		Provider:  domains.Ggkeystore,
+		Methods:   []domains.PaymentMethod{domains.PromptPay},
+		MinAmount: d("100"),
+	})
+	r.Register(domains.LapakGaming, none, domains.ProviderCapabilities{
+		Provider:      domains.LapakGaming,
+		Methods:       []domains.PaymentMethod{domains.PromptPay},
+		Denominations: []decimal.Decimal{d("50")},
+	})
+
+	tests := []struct {
+		name      string
+		preferred domains.PaymentProvider
+		method    domains.PaymentMethod
+		amount    string
+		want      []domains.PaymentProvider
+		wantErr   error
+	}{
+		{"default first", "", domains.PromptPay, "500", []domains.PaymentProvider{domains.Seagm, domains.Ggkeystore}, nil},
+		{"preferred first", domains.Ggkeystore, domains.PromptPay, "500", []domains.PaymentProvider{domains.Ggkeystore, domains.Seagm}, nil},
+		{"amount filters", "", domains.PromptPay, "50", []domains.PaymentProvider{domains.Seagm, domains.LapakGaming}, nil},
+		{"above every max but one", "", domains.PromptPay, "5000", []domains.PaymentProvider{domains.Ggkeystore}, nil},
+		{"unconfigured preferred skipped", "unknown", domains.PromptPay, "500", []domains.PaymentProvider{domains.Seagm, domains.Ggkeystore}, nil},
+		{"no provider takes amount", "", domains.PromptPay, "5", nil, domains.ErrInvalidAmount},
+		{"no provider takes method", "", domains.PaymentMethod("card"), "500", nil, domains.ErrUnsupportedMethod},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Route(tt.preferred, tt.method, d(tt.amount))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
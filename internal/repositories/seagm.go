@@ -2,139 +2,95 @@ package repositories
 
 import (
 	"app/internal/domains"
+	"app/internal/logging"
 	"app/internal/ports"
-	"bytes"
 	"context"
-	"encoding/base64"
-	"errors"
-	"image"
-	"log"
+	"fmt"
+	"log/slog"
 	"strings"
 	"time"
 
-	_ "image/jpeg"
-	_ "image/png"
-
-	cu "github.com/Davincible/chromedp-undetected"
 	"github.com/chromedp/chromedp"
-	goqr "github.com/liyue201/goqr"
-	"github.com/patrickmn/go-cache"
-	"github.com/robfig/cron"
-	"github.com/shopspring/decimal"
 )
 
 type seagm struct {
-	mainCtx        context.Context
-	mainCancelFunc context.CancelFunc
+	*accountBrowser
+	id string
 
 	tabCtx        context.Context
 	tabCancelFunc context.CancelFunc
 }
 
-func NewSeagm(email, password string) ports.PaymentRepository {
-	ctx, cancel, err := cu.New(cu.NewConfig())
-	if err != nil {
-		return nil
-	}
+var seagmCapabilities = domains.ProviderCapabilities{
+	Provider: domains.Seagm,
+	Methods:  []domains.PaymentMethod{domains.PromptPay},
+}
 
-	if err := chromedp.Run(ctx,
-		chromedp.Navigate("https://member.seagm.com/en-th/sso/login"),
-	); err != nil {
-		return nil
+// NewSeagm signs email in to SEAGM on the browser every payment opens its
+// tabs in.
+func NewSeagm(email, password string, pool BrowserPool, store LoginStore) ports.PaymentRepository {
+	login := accountLogin{
+		store:       store,
+		provider:    domains.Seagm,
+		account:     string(domains.Seagm) + ":" + email,
+		origins:     []string{"https://www.seagm.com/en-th", "https://member.seagm.com/en-th"},
+		checkURL:    "https://www.seagm.com/en-th/ucp/topup",
+		loginMarker: "/sso/login",
+		login: func() chromedp.Tasks {
+			return seagmLogin(email, password)
+		},
 	}
-
-	if err := chromedp.Run(ctx,
-		chromedp.Navigate("https://member.seagm.com/en-th/sso/login"),
-		chromedp.WaitVisible(`button[id="CybotCookiebotDialogBodyLevelButtonLevelOptinAllowAll"]`, chromedp.ByQuery),
-		chromedp.Click(`button[id="CybotCookiebotDialogBodyLevelButtonLevelOptinAllowAll"]`, chromedp.ByQuery),
-		chromedp.WaitVisible(`input[id="login_email"]`, chromedp.ByQuery),
-		chromedp.SetValue(`input[id="login_email"]`, email, chromedp.ByQuery),
-		chromedp.SetValue(`input[id="login_pass"]`, password, chromedp.ByQuery),
-		chromedp.Sleep(2*time.Second), // Just to see the result
-		chromedp.WaitReady(`label[id="login_btw"]`, chromedp.ByQuery),
-		chromedp.Click(`label[id="login_btw"]`, chromedp.ByQuery),
-		chromedp.WaitReady(`div[id="main_nav"]`, chromedp.ByQuery),
-		chromedp.Navigate("https://www.seagm.com/en-th/language_currency"),
-		chromedp.WaitReady(`div.region_item[region="th"][region-currency="THB"]`, chromedp.ByQuery),
-		chromedp.Click(`div.region_item[region="th"][region-currency="THB"]`, chromedp.ByQuery),
-	); err != nil {
+	browser, err := newAccountBrowser(pool, string(domains.Seagm), login)
+	if err != nil {
+		slog.Error("failed to start browser", logging.KeyProvider, domains.Seagm, "error", err)
 		return nil
 	}
-
-	browserCtx, cancelBrowser := chromedp.NewContext(ctx)
-
-	cronjob := cron.New()
-	cronjob.AddFunc("@hourly", func() {
-		var currentURL string
-		chromedp.Run(browserCtx,
-			chromedp.Reload(),
-			chromedp.Location(&currentURL),
-		)
-		if strings.Contains(currentURL, "https://www.seagm.com/en-th/sso/login") {
-			if err := chromedp.Run(ctx,
-				chromedp.Navigate("https://member.seagm.com/en-th/sso/login"),
-				chromedp.WaitVisible(`button[id="CybotCookiebotDialogBodyLevelButtonLevelOptinAllowAll"]`, chromedp.ByQuery),
-				chromedp.Click(`button[id="CybotCookiebotDialogBodyLevelButtonLevelOptinAllowAll"]`, chromedp.ByQuery),
-				chromedp.WaitVisible(`input[id="login_email"]`, chromedp.ByQuery),
-				chromedp.SetValue(`input[id="login_email"]`, email, chromedp.ByQuery),
-				chromedp.SetValue(`input[id="login_pass"]`, password, chromedp.ByQuery),
-				chromedp.Sleep(2*time.Second), // Just to see the result
-				chromedp.WaitReady(`label[id="login_btw"]`, chromedp.ByQuery),
-				chromedp.Click(`label[id="login_btw"]`, chromedp.ByQuery),
-				chromedp.WaitReady(`div[id="main_nav"]`, chromedp.ByQuery),
-				chromedp.Navigate("https://www.seagm.com/en-th/language_currency"),
-				chromedp.WaitReady(`div.region_item[region="th"][region-currency="THB"]`, chromedp.ByQuery),
-				chromedp.Click(`div.region_item[region="th"][region-currency="THB"]`, chromedp.ByQuery),
-			); err != nil {
-				log.Println("Error re-authenticating SEAGM:", err)
-			}
-		}
-	})
-	cronjob.Start()
-
-	sg := &seagm{
-		mainCtx: browserCtx,
-		mainCancelFunc: func() {
-			cancel()
-			cancelBrowser()
-			cronjob.Stop()
-		},
-	}
-
-	return sg
+	return &seagm{accountBrowser: browser}
 }
 
-func (sg *seagm) NewPayment(id string) (ports.PaymentRepository, error) {
-	tabCtx, cancelTab := chromedp.NewContext(sg.mainCtx)
+func (sg *seagm) NewPayment(ctx context.Context, id string) (ports.PaymentRepository, error) {
+	lease, err := sg.pool.Lease(ctx, sg.profile)
+	if err != nil {
+		return nil, err
+	}
 	sgg := &seagm{
-		mainCtx:        sg.mainCtx,
-		mainCancelFunc: sg.mainCancelFunc,
-		tabCtx:         tabCtx,
-		tabCancelFunc:  cancelTab,
+		accountBrowser: sg.accountBrowser,
+		id:             id,
+		tabCtx:         lease.Context(),
+		tabCancelFunc:  lease.Release,
 	}
-	chromdpWorker.Set(id, sgg, cache.DefaultExpiration)
+	chromdpWorker.Set(id, domains.Seagm, sgg)
 	return sgg, nil
 }
 
-func (sg *seagm) SubmitPayment(id string, method domains.PaymentMethod, phone string, amount decimal.Decimal, callBackProgress func(uint)) (urlRedirect, qrData, message, orderid string, err error) {
+func (sg *seagm) SubmitPayment(ctx context.Context, request domains.PaymentRequest, callBackProgress func(uint)) (result domains.PaymentResult, err error) {
+	runCtx, cancel := bindContext(ctx, sg.tabCtx)
+	defer cancel()
 
 	//set amount
 
-	if err = chromedp.Run(sg.tabCtx,
+	var topupURL string
+	if err = runStep(runCtx, "navigate topup",
 		chromedp.Navigate("https://www.seagm.com/en-th/ucp/topup"),
+		chromedp.Location(&topupURL),
 	); err != nil {
 		return
 	}
+	if strings.Contains(topupURL, "/sso/login") {
+		sg.loggedIn.Store(false)
+		err = domains.ErrProviderLoggedOut
+		return
+	}
 
-	if err = chromedp.Run(sg.tabCtx,
+	if err = runStep(runCtx, "set amount",
 		chromedp.WaitReady(`input#top_up_amount`, chromedp.ByQuery),
-		chromedp.SetValue(`input#top_up_amount`, amount.String(), chromedp.ByQuery),
+		chromedp.SetValue(`input#top_up_amount`, request.Amount.String(), chromedp.ByQuery),
 		chromedp.Click(`input#submit`, chromedp.ByQuery),
 	); err != nil {
 		return
 	}
 
-	if err = chromedp.Run(sg.tabCtx,
+	if err = runStep(runCtx, "choose promptpay",
 		chromedp.Sleep(2*time.Second), // Just to see the result
 		chromedp.WaitReady(`div.channel[data-method-code="promptpay_qr"]`, chromedp.ByQuery),
 		chromedp.Click(`div.channel[data-method-code="promptpay_qr"]`, chromedp.ByQuery),
@@ -142,62 +98,75 @@ func (sg *seagm) SubmitPayment(id string, method domains.PaymentMethod, phone st
 		return
 	}
 
-	if err = chromedp.Run(sg.tabCtx,
+	if err = runStep(runCtx, "pay now",
 		chromedp.WaitReady(`label.paynow.btw`, chromedp.ByQuery),
 		chromedp.Click(`label.paynow.btw`, chromedp.ByQuery),
 	); err != nil {
 		return
 	}
+	// "pay now" places the order without showing its id, so nothing after
+	// this point may fail over to another provider.
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("%w: %w", domains.ErrOrderPlaced, err)
+		}
+	}()
 
 	var qrBase64 string
-	err = chromedp.Run(sg.tabCtx,
+	err = runStep(runCtx, "read qr",
 		chromedp.WaitReady(`img[alt="QR image"]`),
 		chromedp.AttributeValue(`img[alt="QR image"]`, "src", &qrBase64, nil),
 	)
 	if err != nil {
 		return
 	}
-	base64Str := strings.TrimPrefix(qrBase64, "data:image/png;base64,")
-	base64Str = strings.TrimPrefix(base64Str, "data:image/jpeg;base64,")
-	imgBytes, decodeErr := base64.StdEncoding.DecodeString(base64Str)
-	if decodeErr != nil {
-		return
-	}
-	img, _, decodeErr := image.Decode(bytes.NewReader(imgBytes))
-	if decodeErr != nil {
-		return
-	}
-	codes, scanErr := goqr.Recognize(img)
-	if scanErr != nil {
-		return
-	}
-	if len(codes) == 0 {
-		err = errors.New("no QR code found in image")
+	qrData, err := decodeQr(ctx, qrBase64)
+	if err != nil {
 		return
 	}
 
 	var currentURL string
-	err = chromedp.Run(sg.tabCtx,
+	err = runStep(runCtx, "read payment url",
 		chromedp.Location(&currentURL),
 	)
 	if err != nil {
 		return
 	}
 
-	// use the first detected QR code payload
-	qrData = string(codes[0].Payload)
-	urlRedirect = currentURL
+	result.QrData = qrData
+	result.RedirectUrl = currentURL
+	result.ExpiresAt = time.Now().Add(promptPayQrLifetime)
+	result.Screenshots = screenshots(runCtx)
 	return
 }
 
-func (sg *seagm) SubmitOtp(id string, otp string) (urlRedirect, qrData, message string, err error) {
-	return "", "", "", nil
+func (sg *seagm) SubmitOtp(ctx context.Context, id string, otp string) (domains.PaymentResult, error) {
+	return domains.PaymentResult{}, nil
+}
+
+func seagmLogin(email, password string) chromedp.Tasks {
+	return chromedp.Tasks{
+		chromedp.Navigate("https://member.seagm.com/en-th/sso/login"),
+		chromedp.WaitVisible(`button[id="CybotCookiebotDialogBodyLevelButtonLevelOptinAllowAll"]`, chromedp.ByQuery),
+		chromedp.Click(`button[id="CybotCookiebotDialogBodyLevelButtonLevelOptinAllowAll"]`, chromedp.ByQuery),
+		chromedp.WaitVisible(`input[id="login_email"]`, chromedp.ByQuery),
+		chromedp.SetValue(`input[id="login_email"]`, email, chromedp.ByQuery),
+		chromedp.SetValue(`input[id="login_pass"]`, password, chromedp.ByQuery),
+		chromedp.Sleep(2 * time.Second), // Just to see the result
+		chromedp.WaitReady(`label[id="login_btw"]`, chromedp.ByQuery),
+		chromedp.Click(`label[id="login_btw"]`, chromedp.ByQuery),
+		chromedp.WaitReady(`div[id="main_nav"]`, chromedp.ByQuery),
+		chromedp.Navigate("https://www.seagm.com/en-th/language_currency"),
+		chromedp.WaitReady(`div.region_item[region="th"][region-currency="THB"]`, chromedp.ByQuery),
+		chromedp.Click(`div.region_item[region="th"][region-currency="THB"]`, chromedp.ByQuery),
+	}
 }
 
 func (sg *seagm) Close() {
 	if sg.tabCancelFunc != nil {
 		sg.tabCancelFunc()
+		chromdpWorker.Remove(sg.id, sg)
 	} else {
-		sg.mainCancelFunc()
+		sg.stop()
 	}
 }
@@ -0,0 +1,138 @@
+package repositories
+
+import (
+	"app/internal/domains"
+	"app/internal/ports"
+	"sort"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// sessionTTL is how long a payment's browser tab is kept before it is
+// evicted and closed.
+const sessionTTL = time.Hour
+
+// sessionSweepInterval is how often expired sessions are evicted.
+const sessionSweepInterval = time.Minute
+
+var chromdpWorker = newSessionRegistry(sessionTTL, sessionSweepInterval)
+
+// sessionRegistry holds the provider instance driving each payment's browser
+// tab, keyed by payment id. Evicting or deleting an entry closes the tab, so
+// abandoned sessions do not keep Chrome tabs open.
+type sessionRegistry struct {
+	cache *cache.Cache
+}
+
+type sessionEntry struct {
+	repo      ports.PaymentRepository
+	provider  domains.PaymentProvider
+	startedAt time.Time
+}
+
+func newSessionRegistry(ttl time.Duration, sweepInterval time.Duration) *sessionRegistry {
+	c := cache.New(ttl, sweepInterval)
+	c.OnEvicted(func(id string, value any) {
+		if entry, ok := value.(sessionEntry); ok {
+			entry.repo.Close()
+		}
+	})
+	return &sessionRegistry{cache: c}
+}
+
+// Set registers repo, an instance of provider, as the session of payment id,
+// closing any session it replaces.
+func (r *sessionRegistry) Set(id string, provider domains.PaymentProvider, repo ports.PaymentRepository) {
+	if old, found := r.Get(id); found && old != repo {
+		r.Delete(id)
+	}
+	r.cache.SetDefault(id, sessionEntry{
+		repo:      repo,
+		provider:  provider,
+		startedAt: time.Now(),
+	})
+}
+
+func (r *sessionRegistry) Get(id string) (ports.PaymentRepository, bool) {
+	value, found := r.cache.Get(id)
+	if !found {
+		return nil, false
+	}
+	return value.(sessionEntry).repo, true
+}
+
+// Delete removes the session of payment id and closes it.
+func (r *sessionRegistry) Delete(id string) {
+	r.cache.Delete(id)
+}
+
+// Remove deletes the session of payment id only while it is still repo, so
+// closing an earlier attempt leaves the tab of a newer one alone. Providers
+// call it from Close, which the eviction then runs again; Close must
+// tolerate that.
+func (r *sessionRegistry) Remove(id string, repo ports.PaymentRepository) {
+	if current, found := r.Get(id); found && current == repo {
+		r.Delete(id)
+	}
+}
+
+// Session is a browser tab held for a payment.
+type Session struct {
+	PaymentId string                  `json:"paymentId"`
+	Provider  domains.PaymentProvider `json:"provider"`
+	StartedAt time.Time               `json:"startedAt"`
+	Age       string                  `json:"age"`
+	ExpiresAt time.Time               `json:"expiresAt"`
+}
+
+// LookupSession returns the provider instance whose tab is open for payment
+// id, for steps after SubmitPayment such as SubmitOtp.
+func LookupSession(id string) (ports.PaymentRepository, bool) {
+	return chromdpWorker.Get(id)
+}
+
+// CloseSession closes the browser tab still held for a payment, if any, and
+// reports whether there was one.
+func CloseSession(id string) bool {
+	if _, found := chromdpWorker.Get(id); !found {
+		return false
+	}
+	chromdpWorker.Delete(id)
+	return true
+}
+
+// Sessions lists the browser tabs currently held for payments, oldest first.
+func Sessions() []Session {
+	now := time.Now()
+	items := chromdpWorker.cache.Items()
+	sessions := make([]Session, 0, len(items))
+	for id, item := range items {
+		entry := item.Object.(sessionEntry)
+		sessions = append(sessions, Session{
+			PaymentId: id,
+			Provider:  entry.provider,
+			StartedAt: entry.startedAt,
+			Age:       now.Sub(entry.startedAt).Round(time.Second).String(),
+			ExpiresAt: time.Unix(0, item.Expiration),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.Before(sessions[j].StartedAt)
+	})
+	return sessions
+}
+
+// SessionCount returns how many browser tabs are held for payments.
+func SessionCount() int {
+	return chromdpWorker.cache.ItemCount()
+}
+
+// SessionCounts returns how many browser tabs each provider holds.
+func SessionCounts() map[domains.PaymentProvider]int {
+	counts := map[domains.PaymentProvider]int{}
+	for _, item := range chromdpWorker.cache.Items() {
+		counts[item.Object.(sessionEntry).provider]++
+	}
+	return counts
+}
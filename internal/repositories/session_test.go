@@ -0,0 +1,85 @@
+package repositories
+
+import (
+	"app/internal/domains"
+	"app/internal/ports"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeSession struct {
+	closed atomic.Int32
+}
+
+func (f *fakeSession) NewPayment(ctx context.Context, id string) (ports.PaymentRepository, error) {
+	return f, nil
+}
+
+func (f *fakeSession) SubmitPayment(ctx context.Context, request domains.PaymentRequest, callBackProgress func(uint)) (domains.PaymentResult, error) {
+	return domains.PaymentResult{}, nil
+}
+
+func (f *fakeSession) SubmitOtp(ctx context.Context, id string, otp string) (domains.PaymentResult, error) {
+	return domains.PaymentResult{}, nil
+}
+
+func (f *fakeSession) Login(ctx context.Context) error { return nil }
+func (f *fakeSession) LoggedIn() bool                  { return true }
+func (f *fakeSession) Close()                          { f.closed.Add(1) }
+
+func TestSessionRegistrySetReplacesAndCloses(t *testing.T) {
+	r := newSessionRegistry(time.Hour, time.Hour)
+	first, second := &fakeSession{}, &fakeSession{}
+
+	r.Set("p1", domains.Seagm, first)
+	r.Set("p1", domains.Seagm, first)
+	if n := first.closed.Load(); n != 0 {
+		t.Fatalf("setting the same session again closed it %d times", n)
+	}
+	r.Set("p1", domains.Ggkeystore, second)
+	if n := first.closed.Load(); n != 1 {
+		t.Fatalf("replaced session closed %d times, want 1", n)
+	}
+	got, ok := r.Get("p1")
+	if !ok || got != second {
+		t.Fatalf("Get = %v, %v; want the replacing session", got, ok)
+	}
+}
+
+func TestSessionRegistryRemoveOnlyOwnEntry(t *testing.T) {
+	r := newSessionRegistry(time.Hour, time.Hour)
+	older, newer := &fakeSession{}, &fakeSession{}
+	r.Set("p1", domains.Seagm, older)
+	r.Set("p1", domains.Seagm, newer)
+
+	r.Remove("p1", older)
+	if _, ok := r.Get("p1"); !ok {
+		t.Fatal("removing an older attempt dropped the newer session")
+	}
+	r.Remove("p1", newer)
+	if _, ok := r.Get("p1"); ok {
+		t.Fatal("session still registered after Remove")
+	}
+	if n := newer.closed.Load(); n != 1 {
+		t.Fatalf("removed session closed %d times, want 1", n)
+	}
+}
+
+func TestSessionRegistryEvictionCloses(t *testing.T) {
+	r := newSessionRegistry(20*time.Millisecond, 5*time.Millisecond)
+	session := &fakeSession{}
+	r.Set("p1", domains.Seagm, session)
+
+	deadline := time.Now().Add(time.Second)
+	for session.closed.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired session was never closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok := r.Get("p1"); ok {
+		t.Fatal("expired session still registered")
+	}
+}
@@ -1,66 +1,82 @@
 package repositories
 
 import (
+	"app/internal/tracing"
 	"context"
 	"errors"
-	"sync"
 	"time"
 
-	cu "github.com/Davincible/chromedp-undetected"
 	"github.com/chromedp/chromedp"
 	"github.com/patrickmn/go-cache"
 )
 
 type VerifyRepository interface {
-	VerifyByUrl(url string) (bool, error)
+	VerifyByUrl(ctx context.Context, url string) (bool, error)
 }
 
 type verifyRepository struct {
+	pool BrowserPool
 }
 
 var urlCache = cache.New(5*time.Minute, 10*time.Minute)
 
-func NewVerifyRepository() VerifyRepository {
-	return &verifyRepository{}
+// verifyProfile is the pool profile payment pages are checked in.
+const verifyProfile = "verify"
+
+func NewVerifyRepository(pool BrowserPool) VerifyRepository {
+	pool.Register(BrowserProfile{Name: verifyProfile, Isolated: true})
+	return &verifyRepository{pool: pool}
 }
 
-func (r *verifyRepository) VerifyByUrl(url string) (paymentSuccess bool, err error) {
+func (r *verifyRepository) VerifyByUrl(ctx context.Context, url string) (paymentSuccess bool, err error) {
+	ctx, span := tracing.Start(ctx, "verify by url")
+	defer func() { tracing.End(span, err) }()
 	if _, found := urlCache.Get(url); found {
 		return false, errors.New("URL is being processed")
 	}
-	ctx, cancel, err := cu.New(cu.NewConfig())
+	lease, err := r.pool.Lease(ctx, verifyProfile)
 	if err != nil {
 		return
 	}
-	defer cancel()
+	defer lease.Release()
+	runCtx, cancelRun := bindContext(ctx, lease.Context())
+	defer cancelRun()
 	urlCache.Set(url, true, cache.DefaultExpiration)
 	defer urlCache.Delete(url)
 
-	ctxT, cancelT := context.WithTimeout(ctx, 30*time.Second)
+	if err = runStep(runCtx, "open payment page", chromedp.Navigate(url)); err != nil {
+		return
+	}
+
+	// Whichever message shows up first decides; each watcher reports on its
+	// own channel and the other is cancelled on return.
+	ctxT, cancelT := context.WithTimeout(runCtx, 30*time.Second)
 	defer cancelT()
-	var wg sync.WaitGroup
-	wg.Add(2)
+	failed := make(chan error, 1)
+	complete := make(chan error, 1)
 	go func() {
-		defer wg.Done()
-		if errT := chromedp.Run(ctxT,
-			chromedp.WaitVisible(`*:contains("Payment Failed!")`, chromedp.ByQuery),
-		); errT != nil {
-			err = errT
-			return
-		}
+		failed <- runTraced(ctxT, "wait payment failed",
+			chromedp.WaitVisible(`//*[contains(text(), "Payment Failed!")]`, chromedp.BySearch),
+		)
 	}()
 	go func() {
-		defer wg.Done()
-		if errT := chromedp.Run(ctxT,
-			chromedp.WaitVisible(`*:contains("Payment Complete!")`, chromedp.ByQuery)); errT != nil {
+		complete <- runTraced(ctxT, "wait payment complete",
+			chromedp.WaitVisible(`//*[contains(text(), "Payment Complete!")]`, chromedp.BySearch),
+		)
+	}()
+	for range 2 {
+		select {
+		case errT := <-complete:
+			if errT == nil {
+				return true, nil
+			}
+			err = errT
+		case errT := <-failed:
+			if errT == nil {
+				return false, nil
+			}
 			err = errT
-			return
 		}
-		paymentSuccess = true
-	}()
-	wg.Wait()
-	if paymentSuccess {
-		return true, nil
 	}
-	return
+	return false, err
 }
@@ -2,66 +2,481 @@ package services
 
 import (
 	"app/internal/domains"
-	"app/internal/ports"
+	"app/internal/logging"
+	"app/internal/metrics"
 	"app/internal/repositories"
+	"app/internal/tracing"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type exportService struct {
-	PaymentRepo ports.PaymentRepository
-	Pocketbase  repositories.PocketBase
+	Providers  repositories.PaymentRegistry
+	Pocketbase repositories.PocketBase
+	Status     PaymentStatusService
+	Locale     string
+	PaymentTTL time.Duration
+	Lifecycle  Lifecycle
+	Slots      *ProviderSlots
+	inFlight   sync.Map
+	listening  atomic.Bool
 }
 
 type ExportService interface {
-	ListeningOrder(collection string) (domains.Listening, domains.StopListening, chan domains.RecordHook[domains.PaymentRecord], chan error)
+	ListenOrders(ctx context.Context, collection string, handle func(domains.RecordHook[domains.PaymentRecord])) error
+	// Listening reports whether the realtime subscription is connected.
+	Listening() bool
 
-	ExportPayment(collection string, record domains.RecordHook[domains.PaymentRecord]) error
+	ExportPayment(ctx context.Context, collection string, record domains.RecordHook[domains.PaymentRecord]) error
+	Capabilities() []domains.ProviderCapabilities
+	PublishCapabilities(ctx context.Context, collection string) error
+	// RecoverStuckPayments hands the payments it resumes to submit, e.g.
+	// ExportPool.Submit, so they queue like new ones.
+	RecoverStuckPayments(ctx context.Context, collection string, stuckAfter time.Duration, resumeWithin time.Duration, submit func(ctx context.Context, collection string, record domains.RecordHook[domains.PaymentRecord]) error) error
+	MarkInterrupted(ctx context.Context, collection string, id string) error
+	Reopen(ctx context.Context, collection string, id string) (domains.PaymentRecord, error)
+	Login(ctx context.Context, provider domains.PaymentProvider) error
+	Sessions() []repositories.Session
+	SessionCounts() map[domains.PaymentProvider]int
+	// CloseSession closes the browser tab held for payment id and reports
+	// whether there was one.
+	CloseSession(id string) bool
+	// SubmitOtp enters otp in the browser tab still held for payment id and
+	// closes the tab once the provider accepted it.
+	SubmitOtp(ctx context.Context, id string, otp string) (domains.PaymentResult, error)
+	ProviderLoginState() map[domains.PaymentProvider]bool
 }
 
-func NewExportService(paymentRepo ports.PaymentRepository, pb repositories.PocketBase) ExportService {
+// ErrNoSession is returned for a payment that has no browser tab open, e.g.
+// because it already expired.
+var ErrNoSession = errors.New("no browser session")
+
+const defaultPaymentMethod = domains.PromptPay
+
+const paymentAttemptTimeout = 3 * time.Minute
+
+// interruptedMessage is left on payments a shutdown cut off mid-export. The
+// next recovery run resumes or rejects them.
+const interruptedMessage = "Payment was interrupted by a restart"
+
+func NewExportService(providers repositories.PaymentRegistry, pb repositories.PocketBase, locale string, paymentTTL time.Duration, lifecycle Lifecycle, slots *ProviderSlots) ExportService {
 	return &exportService{
-		PaymentRepo: paymentRepo,
-		Pocketbase:  pb,
+		Providers:  providers,
+		Pocketbase: pb,
+		Status:     NewPaymentStatusService(pb),
+		Locale:     locale,
+		PaymentTTL: paymentTTL,
+		Lifecycle:  lifecycle,
+		Slots:      slots,
 	}
 }
 
-func (s *exportService) ListeningOrder(collection string) (domains.Listening, domains.StopListening, chan domains.RecordHook[domains.PaymentRecord], chan error) {
-	Start, Stop, RecordChan, ErrChan := s.Pocketbase.Subscribe(collection, domains.PaymentRecord{})
+func (s *exportService) ExportPayment(ctx context.Context, collection string, record domains.RecordHook[domains.PaymentRecord]) (err error) {
+	if record.Action != "create" {
+		return nil
+	}
+	logger := logging.Payment(record.Record.Id, record.Record.UserId, record.Record.Provider, "export")
+	if _, running := s.inFlight.LoadOrStore(record.Record.Id, struct{}{}); running {
+		logger.Info("skipping payment already being exported")
+		return nil
+	}
+	defer s.inFlight.Delete(record.Record.Id)
+	done, err := s.Lifecycle.Begin(TaskExport, collection, record.Record.Id)
+	if err != nil {
+		return err
+	}
+	defer done()
 
-	return Start, Stop, RecordChan, ErrChan
-}
+	ctx, span := tracing.Start(ctx, "export payment", attribute.String(logging.KeyPaymentId, record.Record.Id))
+	defer func() { tracing.End(span, err) }()
+	// Record keeping outlives cancellation so a shutdown mid-attempt still
+	// leaves the attempts and status behind for recovery.
+	recordCtx := context.WithoutCancel(ctx)
 
-func (s *exportService) ExportPayment(collection string, record domains.RecordHook[domains.PaymentRecord]) error {
-	if record.Action != "create" {
+	current, err := repositories.Get[domains.PaymentRecord](recordCtx, s.Pocketbase, collection, record.Record.Id)
+	if err != nil {
+		return fmt.Errorf("failed to load payment %s before export: %w", record.Record.Id, err)
+	}
+	if exported, reason := alreadyExported(current); exported {
+		logger.Info("skipping replayed payment", "reason", reason)
 		return nil
 	}
-	s.Pocketbase.UpdateRecord(collection, record.Record.Id, map[string]any{"status": "system-preparing"})
-	fmt.Printf("New payment record created: %+v\n", record)
-	s.Pocketbase.UpdateRecord(collection, record.Record.Id, map[string]any{"progress": 10})
 
-	paymentInstance, err := s.PaymentRepo.NewPayment(record.Record.Id)
+	if err := s.Status.Transition(recordCtx, collection, record.Record.Id, domains.StatusSystemPreparing, "", map[string]any{"progress": 10}); err != nil {
+		return err
+	}
+	logger.Info("exporting payment", "amount", record.Record.Amount)
+
+	providers, err := s.Providers.Route(domains.PaymentProvider(record.Record.Provider), defaultPaymentMethod, record.Record.Amount)
+	if err != nil {
+		logger.Warn("failed to route payment", "error", err)
+		if rejectErr := s.Status.Transition(recordCtx, collection, record.Record.Id, domains.StatusReject, domains.UserMessage(err, s.Locale), map[string]any{"error": err.Error(), "progress": 100}); rejectErr != nil {
+			logger.Error("failed to reject unroutable payment", "error", rejectErr)
+			return errors.Join(err, rejectErr)
+		}
+		return err
+	}
+	// Paused providers are skipped; a payment only paused ones can take
+	// waits here for a Resume.
+	providers, err = s.Slots.Unpaused(ctx, providers)
 	if err != nil {
-		s.Pocketbase.UpdateRecord(collection, record.Record.Id, map[string]any{"status": "reject", "message": fmt.Sprintf("Failed to create LapakGaming payment: %v", err), "progress": 100})
-		fmt.Println("Failed to create LapakGaming payment:", err)
+		if err := s.MarkInterrupted(recordCtx, collection, record.Record.Id); err != nil {
+			logger.Error("failed to mark payment interrupted", "error", err)
+		}
 		return err
 	}
-	defer paymentInstance.Close()
-
-	s.Pocketbase.UpdateRecord(collection, record.Record.Id, map[string]any{"progress": 40})
-	if urlRedirect, qrCode, message, orderid, err := paymentInstance.SubmitPayment(record.Record.Id, domains.PromptPay, "", record.Record.Amount, func(progress uint) {
-		fmt.Println("Payment progress:", progress)
-		s.Pocketbase.UpdateRecord(collection, record.Record.Id, map[string]any{"progress": progress + 40})
-	}); err != nil {
-		s.Pocketbase.UpdateRecord(collection, record.Record.Id, map[string]any{"status": "reject", "message": fmt.Sprintf("Failed to submit payment: %v", err), "progress": 100})
-		fmt.Println("Failed to submit payment:", err)
-	} else {
-		err = s.Pocketbase.UpdateRecord(collection, record.Record.Id, map[string]any{"status": "user-paying", "orderId": orderid, "qrCode": qrCode, "paymentUrl": urlRedirect, "message": message, "progress": 100})
+
+	var lastErr error
+	attempts := append([]domains.PaymentAttempt{}, current.Attempts...)
+	for _, provider := range providers {
+		logger := logger.With(logging.KeyProvider, provider)
+		result, err := s.attemptPayment(logging.WithLogger(ctx, logger), collection, record.Record, provider)
+		attempt := domains.PaymentAttempt{
+			Provider: provider,
+			OrderId:  result.OrderId,
+			Created:  time.Now().UTC().Format(time.RFC3339),
+		}
 		if err != nil {
-			s.Pocketbase.UpdateRecord(collection, record.Record.Id, map[string]any{"status": "reject", "message": fmt.Sprintf("Failed to update record after payment submission: %v", err), "progress": 100})
-			fmt.Println("Failed to update record after payment submission:", err)
+			attempt.Error = err.Error()
+		}
+		metrics.ExportAttempts.WithLabelValues(string(provider), string(defaultPaymentMethod), exportOutcome(err)).Inc()
+		attempts = append(attempts, attempt)
+		if err := s.Status.Update(recordCtx, collection, record.Record.Id, map[string]any{"usedProvider": provider, "attempts": attempts}); err != nil {
+			// The outcome below still writes the status; only the attempt
+			// history is behind.
+			logger.Error("failed to record payment attempt", "error", err)
+		}
+
+		if err == nil {
+			expiresAt := time.Now().Add(s.PaymentTTL)
+			if !result.ExpiresAt.IsZero() && result.ExpiresAt.Before(expiresAt) {
+				// The configured TTL wins; the customer may still pay through
+				// the payment page after the QR stops working.
+				logger.Debug("provider QR expires before the payment TTL", "qrExpiresAt", result.ExpiresAt)
+			}
+			update := map[string]any{"orderId": result.OrderId, "qrCode": result.QrData, "paymentUrl": result.RedirectUrl, "expiresAt": expiresAt.UTC().Format(repositories.DateTimeLayout), "progress": 100}
+			err = s.Status.Transition(recordCtx, collection, record.Record.Id, domains.StatusUserPaying, result.Message, update)
+			if err != nil {
+				// A tab kept open for an OTP is no use to a rejected payment.
+				repositories.CloseSession(record.Record.Id)
+				logger.Error("failed to update record after payment submission", "error", err)
+				if rejectErr := s.Status.Transition(recordCtx, collection, record.Record.Id, domains.StatusReject, fmt.Sprintf("Failed to update record after payment submission: %v", err), map[string]any{"progress": 100}); rejectErr != nil {
+					logger.Error("failed to reject payment after submission", "error", rejectErr)
+					return errors.Join(err, rejectErr)
+				}
+				return err
+			}
+			logger.Info("payment handed to customer", "orderId", result.OrderId)
+			s.saveScreenshots(recordCtx, logger, collection, record.Record.Id, result.Screenshots)
+			return nil
+		}
+
+		logger.Warn("payment attempt failed", "error", err, "orderId", result.OrderId)
+		lastErr = err
+		if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+			// Shutting down: the task ends before the lifecycle's interrupted
+			// hooks run, so note the interruption here and leave the payment
+			// to recovery.
+			if err := s.MarkInterrupted(recordCtx, collection, record.Record.Id); err != nil {
+				logger.Error("failed to mark payment interrupted", "error", err)
+			}
 			return err
 		}
+		if !isRetryable(err, result.OrderId) {
+			break
+		}
+	}
+
+	if err := s.Status.Transition(recordCtx, collection, record.Record.Id, domains.StatusReject, domains.UserMessage(lastErr, s.Locale), map[string]any{"error": lastErr.Error(), "progress": 100}); err != nil {
+		logger.Error("failed to reject payment", "error", err)
+		return errors.Join(lastErr, err)
+	}
+	return lastErr
+}
+
+// RecoverStuckPayments picks up payments a previous run left unfinished, e.g.
+// because the process died mid-export. Payments that have not been touched
+// for stuckAfter are resumed when they are younger than resumeWithin and no
+// provider order exists yet; anything else is rejected with the reason.
+func (s *exportService) RecoverStuckPayments(ctx context.Context, collection string, stuckAfter time.Duration, resumeWithin time.Duration, submit func(ctx context.Context, collection string, record domains.RecordHook[domains.PaymentRecord]) error) error {
+	now := time.Now().UTC()
+	filter := repositories.And(
+		repositories.Or(
+			repositories.Eq("status", domains.StatusSystemPreparing),
+			repositories.Lt("progress", 100),
+		),
+		repositories.Neq("status", domains.StatusUserPaying),
+		repositories.Neq("status", domains.StatusSuccess),
+		repositories.Neq("status", domains.StatusReject),
+		repositories.Neq("status", domains.StatusExpired),
+		repositories.Neq("status", domains.StatusBusy),
+		repositories.Lt("updated", now.Add(-stuckAfter)),
+	)
+	records, err := repositories.List[domains.PaymentRecord](ctx, s.Pocketbase, collection, repositories.Query{Filter: filter, Sort: repositories.SortBy(repositories.Asc("created"))})
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if _, running := s.inFlight.Load(record.Id); running {
+			continue
+		}
+		logger := logging.Payment(record.Id, record.UserId, record.Provider, "recovery")
+		if reason := unrecoverableReason(record, now, resumeWithin); reason != "" {
+			logger.Warn("rejecting stuck payment", "reason", reason)
+			if err := s.Status.Transition(ctx, collection, record.Id, domains.StatusReject, reason, map[string]any{"progress": 100}); err != nil {
+				logger.Error("failed to reject stuck payment", "error", err)
+			}
+			continue
+		}
+		logger.Info("resuming stuck payment")
+		if err := submit(ctx, collection, domains.RecordHook[domains.PaymentRecord]{Action: "create", Record: record}); err != nil {
+			logger.Error("failed to resume stuck payment", "error", err)
+		}
+	}
+	return nil
+}
+
+// MarkInterrupted notes on a payment that its export was cut off. The status
+// is left alone so RecoverStuckPayments can still resume it.
+func (s *exportService) MarkInterrupted(ctx context.Context, collection string, id string) error {
+	return s.Status.Update(ctx, collection, id, map[string]any{"message": interruptedMessage})
+}
+
+// Reopen resets a rejected or busy payment to pending. The caller queues it
+// for export again.
+func (s *exportService) Reopen(ctx context.Context, collection string, id string) (domains.PaymentRecord, error) {
+	if _, running := s.inFlight.Load(id); running {
+		return domains.PaymentRecord{}, fmt.Errorf("payment %s is being exported", id)
 	}
+	return s.Status.Reopen(ctx, collection, id)
+}
 
+// Login forces provider to sign in again, e.g. after its session was
+// revoked on the provider's side.
+func (s *exportService) Login(ctx context.Context, provider domains.PaymentProvider) error {
+	repo, err := s.Providers.Get(provider)
+	if err != nil {
+		return err
+	}
+	if err := repo.Login(ctx); err != nil {
+		metrics.Reauthentications.WithLabelValues(string(provider), metrics.ResultError).Inc()
+		return err
+	}
+	metrics.Reauthentications.WithLabelValues(string(provider), metrics.ResultSuccess).Inc()
 	return nil
 }
+
+func (s *exportService) SubmitOtp(ctx context.Context, id string, otp string) (domains.PaymentResult, error) {
+	paymentInstance, ok := repositories.LookupSession(id)
+	if !ok {
+		return domains.PaymentResult{}, fmt.Errorf("%w: payment %s", ErrNoSession, id)
+	}
+	result, err := paymentInstance.SubmitOtp(ctx, id, otp)
+	if err != nil {
+		return result, err
+	}
+	repositories.CloseSession(id)
+	return result, nil
+}
+
+func (s *exportService) Sessions() []repositories.Session {
+	return repositories.Sessions()
+}
+
+func (s *exportService) SessionCounts() map[domains.PaymentProvider]int {
+	return repositories.SessionCounts()
+}
+
+func (s *exportService) CloseSession(id string) bool {
+	return repositories.CloseSession(id)
+}
+
+func (s *exportService) ProviderLoginState() map[domains.PaymentProvider]bool {
+	return s.Providers.LoginState()
+}
+
+func unrecoverableReason(record domains.PaymentRecord, now time.Time, resumeWithin time.Duration) string {
+	for _, attempt := range record.Attempts {
+		if attempt.OrderId != "" && !attempt.Superseded {
+			return fmt.Sprintf("Payment was interrupted after %s order %s was created, please create a new payment", attempt.Provider, attempt.OrderId)
+		}
+	}
+	created, err := time.Parse(repositories.DateTimeLayout, record.Created)
+	if err != nil || now.Sub(created) > resumeWithin {
+		return "Payment was interrupted for too long, please create a new payment"
+	}
+	return ""
+}
+
+func (s *exportService) Capabilities() []domains.ProviderCapabilities {
+	return s.Providers.Capabilities()
+}
+
+// PublishCapabilities upserts one record per configured provider and deletes
+// the records of providers no longer configured, so the frontend only offers
+// methods and amounts some provider can take.
+func (s *exportService) PublishCapabilities(ctx context.Context, collection string) error {
+	configured := map[domains.PaymentProvider]bool{}
+	for _, caps := range s.Providers.Capabilities() {
+		configured[caps.Provider] = true
+		data := map[string]any{
+			"provider":      caps.Provider,
+			"methods":       caps.Methods,
+			"minAmount":     caps.MinAmount,
+			"maxAmount":     caps.MaxAmount,
+			"denominations": caps.Denominations,
+			"requiresOtp":   caps.RequiresOtp,
+		}
+		existing, err := repositories.List[domains.ProviderCapabilitiesRecord](ctx, s.Pocketbase, collection, repositories.Query{Filter: repositories.Eq("provider", caps.Provider)})
+		if err != nil {
+			return fmt.Errorf("failed to load %s capabilities: %w", caps.Provider, err)
+		}
+		if len(existing) > 0 {
+			err = s.Pocketbase.UpdateRecord(ctx, collection, existing[0].Id, data)
+		} else {
+			_, err = s.Pocketbase.CreateRecord(ctx, collection, data)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to publish %s capabilities: %w", caps.Provider, err)
+		}
+	}
+
+	published, err := repositories.List[domains.ProviderCapabilitiesRecord](ctx, s.Pocketbase, collection, repositories.Query{})
+	if err != nil {
+		return fmt.Errorf("failed to load published capabilities: %w", err)
+	}
+	for _, record := range published {
+		if configured[record.Provider] {
+			continue
+		}
+		if err := s.Pocketbase.DeleteRecord(ctx, collection, record.Id); err != nil {
+			return fmt.Errorf("failed to unpublish %s capabilities: %w", record.Provider, err)
+		}
+		slog.Info("unpublished capabilities of unconfigured provider", logging.KeyProvider, record.Provider)
+	}
+	return nil
+}
+
+func (s *exportService) attemptPayment(ctx context.Context, collection string, record domains.PaymentRecord, provider domains.PaymentProvider) (_ domains.PaymentResult, err error) {
+	paymentRepo, err := s.Providers.Get(provider)
+	if err != nil {
+		return domains.PaymentResult{}, err
+	}
+
+	ctx, span := tracing.Start(ctx, "payment attempt", attribute.String(logging.KeyProvider, string(provider)))
+	defer func() { tracing.End(span, err) }()
+	recordCtx := context.WithoutCancel(ctx)
+	release, err := s.Slots.Acquire(ctx, provider)
+	if err != nil {
+		return domains.PaymentResult{}, err
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(ctx, paymentAttemptTimeout)
+	defer cancel()
+
+	logger := logging.From(ctx)
+	// Progress is informational, so a failed write is only logged.
+	setProgress := func(progress uint) {
+		if err := s.Status.Update(recordCtx, collection, record.Id, map[string]any{"progress": progress}); err != nil {
+			logger.Warn("failed to record payment progress", "progress", progress, "error", err)
+		}
+	}
+	setProgress(20)
+	stageStart := time.Now()
+	observeStage := func(stage string) {
+		metrics.SubmitStageDuration.WithLabelValues(string(provider), stage).Observe(time.Since(stageStart).Seconds())
+		stageStart = time.Now()
+	}
+	paymentInstance, err := paymentRepo.NewPayment(ctx, record.Id)
+	if err != nil {
+		return domains.PaymentResult{}, fmt.Errorf("failed to create %s payment: %w", provider, err)
+	}
+	defer func() {
+		// Providers that ask for an OTP keep the tab until SubmitOtp or the
+		// payment expires, both of which close the session.
+		if caps, _ := s.Providers.CapabilitiesOf(provider); err != nil || !caps.RequiresOtp {
+			paymentInstance.Close()
+		}
+	}()
+	observeStage("new_payment")
+
+	setProgress(40)
+	request := domains.PaymentRequest{
+		Id:     record.Id,
+		Method: defaultPaymentMethod,
+		Amount: record.Amount,
+	}
+	result, err := paymentInstance.SubmitPayment(ctx, request, func(progress uint) {
+		logger.Debug("payment progress", "progress", progress)
+		observeStage(strconv.FormatUint(uint64(progress), 10))
+		setProgress(progress + 40)
+	})
+	if err == nil {
+		observeStage("done")
+	}
+	return result, err
+}
+
+func exportOutcome(err error) string {
+	if err == nil {
+		return metrics.OutcomeSuccess
+	}
+	switch domains.ClassifyError(err) {
+	case domains.UserFacing:
+		return metrics.OutcomeUserFacing
+	case domains.Fatal:
+		return metrics.OutcomeFatal
+	}
+	return metrics.OutcomeRetryable
+}
+
+func (s *exportService) saveScreenshots(ctx context.Context, logger *slog.Logger, collection string, id string, screenshots [][]byte) {
+	if len(screenshots) == 0 {
+		return
+	}
+	files := make([]io.Reader, 0, len(screenshots))
+	for _, screenshot := range screenshots {
+		files = append(files, bytes.NewReader(screenshot))
+	}
+	if err := s.Pocketbase.AddFile(ctx, collection, id, "screenshots", files...); err != nil {
+		logger.Warn("failed to save payment screenshots", "error", err)
+	}
+}
+
+// alreadyExported reports whether a previous run, possibly before a restart,
+// already got past "system-preparing" or created an order with a provider.
+// The record in PocketBase is the source of truth, so a replayed realtime
+// event never opens a second provider order.
+func alreadyExported(record domains.PaymentRecord) (bool, string) {
+	switch record.Status {
+	case domains.StatusUserPaying, domains.StatusSuccess, domains.StatusReject, domains.StatusExpired, domains.StatusBusy:
+		return true, "status is " + string(record.Status)
+	}
+	for _, attempt := range record.Attempts {
+		if attempt.OrderId != "" && !attempt.Superseded {
+			return true, fmt.Sprintf("%s order %s already exists", attempt.Provider, attempt.OrderId)
+		}
+	}
+	return false, ""
+}
+
+// isRetryable reports whether the next provider should be tried after err.
+// Once a provider has handed back an order id the order exists on its side,
+// so trying another provider would leave the customer with two orders.
+func isRetryable(err error, orderid string) bool {
+	if domains.ClassifyError(err) != domains.Retryable {
+		return false
+	}
+	return orderid == ""
+}
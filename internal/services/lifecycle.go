@@ -0,0 +1,193 @@
+package services
+
+import (
+	"app/internal/logging"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrShuttingDown = errors.New("service is shutting down")
+
+type TaskKind string
+
+const (
+	TaskExport TaskKind = "export"
+	TaskVerify TaskKind = "verify"
+)
+
+type Task struct {
+	Kind       TaskKind  `json:"kind"`
+	Collection string    `json:"collection"`
+	Id         string    `json:"id"`
+	Started    time.Time `json:"started"`
+}
+
+// Lifecycle tracks in-flight exports and verifications so shutdown can wait
+// for them instead of sleeping. Shutdown stops intake, waits for tracked
+// tasks until the timeout, cancels Context, hands whatever is still running
+// to the interrupted hooks and finally runs the close hooks.
+type Lifecycle interface {
+	// Begin registers a task and returns the func that ends it. It fails with
+	// ErrShuttingDown once Shutdown has started.
+	Begin(kind TaskKind, collection string, id string) (func(), error)
+	InFlight() []Task
+	// Context is cancelled when the shutdown timeout runs out; long running
+	// work should use it rather than the signal context.
+	Context() context.Context
+	OnStopIntake(fn func())
+	OnInterrupted(kind TaskKind, fn func(Task))
+	OnClose(fn func())
+	Shutdown(timeout time.Duration)
+	Draining() bool
+}
+
+// interruptGrace is how long cancelled tasks get to unwind, e.g. to close
+// their browser tabs, before they are reported as interrupted.
+var interruptGrace = 5 * time.Second
+
+type lifecycle struct {
+	mu          sync.Mutex
+	draining    bool
+	nextId      int
+	tasks       map[int]Task
+	idle        chan struct{}
+	ctx         context.Context
+	cancel      context.CancelFunc
+	stopIntake  []func()
+	interrupted map[TaskKind][]func(Task)
+	closers     []func()
+}
+
+func NewLifecycle() Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	idle := make(chan struct{})
+	close(idle)
+	return &lifecycle{
+		tasks:       map[int]Task{},
+		idle:        idle,
+		ctx:         ctx,
+		cancel:      cancel,
+		interrupted: map[TaskKind][]func(Task){},
+	}
+}
+
+func (l *lifecycle) Begin(kind TaskKind, collection string, id string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.draining {
+		return nil, fmt.Errorf("%w: %s %s not started", ErrShuttingDown, kind, id)
+	}
+	if len(l.tasks) == 0 {
+		l.idle = make(chan struct{})
+	}
+	key := l.nextId
+	l.nextId++
+	l.tasks[key] = Task{Kind: kind, Collection: collection, Id: id, Started: time.Now()}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			delete(l.tasks, key)
+			if len(l.tasks) == 0 {
+				close(l.idle)
+			}
+		})
+	}, nil
+}
+
+// InFlight returns the running tasks, oldest first.
+func (l *lifecycle) InFlight() []Task {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tasks := make([]Task, 0, len(l.tasks))
+	for _, task := range l.tasks {
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].Started.Before(tasks[j].Started)
+	})
+	return tasks
+}
+
+func (l *lifecycle) Draining() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.draining
+}
+
+func (l *lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+func (l *lifecycle) OnStopIntake(fn func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopIntake = append(l.stopIntake, fn)
+}
+
+func (l *lifecycle) OnInterrupted(kind TaskKind, fn func(Task)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.interrupted[kind] = append(l.interrupted[kind], fn)
+}
+
+func (l *lifecycle) OnClose(fn func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closers = append(l.closers, fn)
+}
+
+func (l *lifecycle) Shutdown(timeout time.Duration) {
+	l.mu.Lock()
+	l.draining = true
+	stopIntake := l.stopIntake
+	closers := l.closers
+	l.mu.Unlock()
+
+	for _, fn := range stopIntake {
+		fn()
+	}
+
+	if !l.wait(timeout) {
+		slog.Warn("tasks still running after shutdown timeout, cancelling them", "tasks", len(l.InFlight()), "timeout", timeout)
+	}
+	l.cancel()
+
+	// Tasks that unwind within the grace record the interruption themselves;
+	// the hooks only see the ones still stuck.
+	l.wait(interruptGrace)
+	for _, task := range l.InFlight() {
+		slog.Warn("task interrupted by shutdown", logging.KeyPaymentId, task.Id, logging.KeyStage, task.Kind)
+		l.mu.Lock()
+		hooks := l.interrupted[task.Kind]
+		l.mu.Unlock()
+		for _, fn := range hooks {
+			fn(task)
+		}
+	}
+
+	for _, fn := range closers {
+		fn()
+	}
+}
+
+// wait blocks until no task is running or timeout passes and reports
+// whether every task finished.
+func (l *lifecycle) wait(timeout time.Duration) bool {
+	l.mu.Lock()
+	idle := l.idle
+	l.mu.Unlock()
+	select {
+	case <-idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLifecycleShutdownWaitsForTasks(t *testing.T) {
+	l := NewLifecycle()
+	end, err := l.Begin(TaskExport, "payments", "a")
+	if err != nil {
+		t.Fatalf("Begin() = %v", err)
+	}
+	if got := l.InFlight(); len(got) != 1 || got[0].Id != "a" {
+		t.Fatalf("InFlight() = %v, want task a", got)
+	}
+
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	l.OnStopIntake(func() {
+		record("stop intake")
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			record("task done")
+			end()
+		}()
+	})
+	l.OnInterrupted(TaskExport, func(task Task) { record("interrupted " + task.Id) })
+	l.OnClose(func() { record("close") })
+
+	l.Shutdown(time.Second)
+
+	want := []string{"stop intake", "task done", "close"}
+	if !slices.Equal(events, want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	if !l.Draining() {
+		t.Fatal("Draining() = false after Shutdown")
+	}
+	if l.Context().Err() == nil {
+		t.Fatal("Context() not cancelled after Shutdown")
+	}
+	if _, err := l.Begin(TaskVerify, "payments", "b"); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("Begin() after Shutdown = %v, want %v", err, ErrShuttingDown)
+	}
+}
+
+func TestLifecycleShutdownInterruptsStuckTasks(t *testing.T) {
+	grace := interruptGrace
+	interruptGrace = 200 * time.Millisecond
+	t.Cleanup(func() { interruptGrace = grace })
+
+	l := NewLifecycle()
+	// unwinds once the lifecycle context is cancelled
+	endUnwinding, err := l.Begin(TaskExport, "payments", "unwinding")
+	if err != nil {
+		t.Fatalf("Begin() = %v", err)
+	}
+	go func() {
+		<-l.Context().Done()
+		endUnwinding()
+	}()
+	// ignores cancellation
+	if _, err := l.Begin(TaskVerify, "payments", "stuck"); err != nil {
+		t.Fatalf("Begin() = %v", err)
+	}
+
+	var interrupted []string
+	l.OnInterrupted(TaskExport, func(task Task) { interrupted = append(interrupted, "export "+task.Id) })
+	l.OnInterrupted(TaskVerify, func(task Task) { interrupted = append(interrupted, "verify "+task.Id) })
+	closed := false
+	l.OnClose(func() { closed = true })
+
+	l.Shutdown(10 * time.Millisecond)
+
+	if want := []string{"verify stuck"}; !slices.Equal(interrupted, want) {
+		t.Fatalf("interrupted = %v, want %v", interrupted, want)
+	}
+	if !closed {
+		t.Fatal("close hooks did not run")
+	}
+}
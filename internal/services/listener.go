@@ -0,0 +1,128 @@
+package services
+
+import (
+	"app/internal/domains"
+	"app/internal/repositories"
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	listenMinBackoff = time.Second
+	listenMaxBackoff = time.Minute
+	// catchUpOverlap widens the catch-up window so records written around
+	// the moment the stream dropped are not missed; replays are skipped by
+	// ExportPayment's idempotency check.
+	catchUpOverlap = time.Minute
+)
+
+// ListenOrders keeps a realtime subscription on collection alive until ctx is
+// done. Dropped streams are reopened with exponential backoff and jitter, and
+// after every (re)connection the records created while disconnected are
+// fetched and handed to handle as "create" events. The first catch-up takes
+// every pending record, so payments created while the process was down are
+// exported right away instead of waiting for recovery.
+func (s *exportService) ListenOrders(ctx context.Context, collection string, handle func(domains.RecordHook[domains.PaymentRecord])) error {
+	var since time.Time
+	attempt := 0
+	for {
+		connectedAt, err := s.listenOnce(ctx, collection, since, handle)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !connectedAt.IsZero() {
+			since = connectedAt
+			attempt = 0
+		}
+		wait := backoffWithJitter(attempt)
+		attempt++
+		slog.Warn("realtime subscription lost, reconnecting", "collection", collection, "error", err, "wait", wait)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// listenOnce runs one subscription until it fails and returns the time of its
+// last successful connection, or the zero time if it never connected.
+func (s *exportService) listenOnce(ctx context.Context, collection string, since time.Time, handle func(domains.RecordHook[domains.PaymentRecord])) (time.Time, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	subscription := repositories.Subscribe[domains.PaymentRecord](ctx, s.Pocketbase, collection)
+	defer subscription.Stop()
+	defer s.listening.Store(false)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- subscription.Start()
+	}()
+
+	var connectedAt time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return connectedAt, ctx.Err()
+		case <-subscription.Connected:
+			catchUpSince := since
+			if !connectedAt.IsZero() {
+				catchUpSince = connectedAt
+			}
+			connectedAt = time.Now()
+			s.listening.Store(true)
+			if err := s.catchUp(ctx, collection, catchUpSince, handle); err != nil {
+				slog.Error("failed to catch up on missed payments", "collection", collection, "error", err)
+			}
+		case record := <-subscription.Records:
+			handle(record)
+		case err := <-subscription.Errors:
+			return connectedAt, err
+		case err := <-done:
+			if err == nil {
+				err = errors.New("stream closed")
+			}
+			return connectedAt, err
+		}
+	}
+}
+
+func (s *exportService) Listening() bool {
+	return s.listening.Load()
+}
+
+// catchUp hands handle the pending records created since, less
+// catchUpOverlap, or every pending record when since is zero.
+func (s *exportService) catchUp(ctx context.Context, collection string, since time.Time, handle func(domains.RecordHook[domains.PaymentRecord])) error {
+	var created repositories.Filter
+	if !since.IsZero() {
+		created = repositories.Gte("created", since.Add(-catchUpOverlap))
+	}
+	filter := repositories.And(
+		created,
+		repositories.Or(
+			repositories.Eq("status", ""),
+			repositories.Eq("status", domains.StatusPending),
+		),
+	)
+	records, err := repositories.List[domains.PaymentRecord](ctx, s.Pocketbase, collection, repositories.Query{Filter: filter, Sort: repositories.SortBy(repositories.Asc("created"))})
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		handle(domains.RecordHook[domains.PaymentRecord]{Action: "create", Record: record})
+	}
+	return nil
+}
+
+// backoffWithJitter returns a random wait in [0, min(max, min*2^attempt)].
+func backoffWithJitter(attempt int) time.Duration {
+	wait := listenMaxBackoff
+	if attempt < 16 {
+		wait = min(listenMinBackoff<<attempt, listenMaxBackoff)
+	}
+	return time.Duration(rand.Int64N(int64(wait) + 1))
+}
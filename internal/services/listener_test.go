@@ -0,0 +1,149 @@
+package services
+
+import (
+	"app/internal/domains"
+	"app/internal/repositories"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStream is a PocketBase whose realtime stream stays connected until a
+// test drops it, and whose list requests return items and record the filter.
+type fakeStream struct {
+	repositories.PocketBase
+	items []domains.PaymentRecord
+	drop  chan error
+
+	mu      sync.Mutex
+	filters []string
+	onEvent func(any)
+}
+
+func (f *fakeStream) Send(ctx context.Context, method string, path string, query map[string]string, body any, result any) error {
+	f.mu.Lock()
+	f.filters = append(f.filters, query["filter"])
+	f.mu.Unlock()
+	*result.(*domains.ListRecordsResponse[domains.PaymentRecord]) = domains.ListRecordsResponse[domains.PaymentRecord]{Items: f.items, TotalPages: 1}
+	return nil
+}
+
+func (f *fakeStream) Subscribe(collection string, event any, onEvent func(any), onConnect func()) (domains.Listening, domains.StopListening, chan error) {
+	f.mu.Lock()
+	f.onEvent = onEvent
+	f.mu.Unlock()
+	stopped := make(chan struct{})
+	var once sync.Once
+	start := func() error {
+		onConnect()
+		select {
+		case err := <-f.drop:
+			return err
+		case <-stopped:
+			return nil
+		}
+	}
+	return start, func() { once.Do(func() { close(stopped) }) }, make(chan error)
+}
+
+func (f *fakeStream) filter(i int) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.filters[i]
+}
+
+func (f *fakeStream) event(record domains.RecordHook[domains.PaymentRecord]) {
+	f.mu.Lock()
+	onEvent := f.onEvent
+	f.mu.Unlock()
+	onEvent(&record)
+}
+
+func receive(t *testing.T, handled chan domains.RecordHook[domains.PaymentRecord]) domains.RecordHook[domains.PaymentRecord] {
+	t.Helper()
+	select {
+	case record := <-handled:
+		return record
+	case <-time.After(5 * time.Second):
+		t.Fatal("no record handled")
+		return domains.RecordHook[domains.PaymentRecord]{}
+	}
+}
+
+func TestListenOrdersCatchesUp(t *testing.T) {
+	var missed domains.PaymentRecord
+	missed.Id = "missed"
+	pb := &fakeStream{items: []domains.PaymentRecord{missed}, drop: make(chan error)}
+	s := &exportService{Pocketbase: pb}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handled := make(chan domains.RecordHook[domains.PaymentRecord], 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenOrders(ctx, "payments", func(record domains.RecordHook[domains.PaymentRecord]) {
+			handled <- record
+		})
+	}()
+
+	if got := receive(t, handled); got.Record.Id != "missed" || got.Action != "create" {
+		t.Fatalf("first catch-up handled %s %q, want create missed", got.Action, got.Record.Id)
+	}
+	if filter := pb.filter(0); strings.Contains(filter, "created") {
+		t.Fatalf("first catch-up filter = %q, want every pending payment", filter)
+	}
+	if !s.Listening() {
+		t.Fatal("Listening() = false while connected")
+	}
+
+	var live domains.RecordHook[domains.PaymentRecord]
+	live.Action = "create"
+	live.Record.Id = "live"
+	pb.event(live)
+	if got := receive(t, handled); got.Record.Id != "live" {
+		t.Fatalf("handled %q, want live", got.Record.Id)
+	}
+
+	dropped := time.Now()
+	pb.drop <- errors.New("stream reset")
+	if got := receive(t, handled); got.Record.Id != "missed" {
+		t.Fatalf("catch-up after reconnect handled %q, want missed", got.Record.Id)
+	}
+	filter := pb.filter(1)
+	_, since, ok := strings.Cut(filter, "created >= '")
+	if !ok {
+		t.Fatalf("catch-up filter after reconnect = %q, want a created bound", filter)
+	}
+	since, _, _ = strings.Cut(since, "'")
+	sinceTime, err := time.Parse(repositories.DateTimeLayout, since)
+	if err != nil {
+		t.Fatalf("created bound %q: %v", since, err)
+	}
+	if sinceTime.After(dropped.Add(-catchUpOverlap)) {
+		t.Fatalf("created bound %v is later than the last connection less the overlap", sinceTime)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("ListenOrders() = %v", err)
+	}
+	if s.Listening() {
+		t.Fatal("Listening() = true after ListenOrders returned")
+	}
+
+	// Nobody reads the records any more; the stream must not block on them.
+	delivered := make(chan struct{})
+	go func() {
+		pb.event(live)
+		pb.event(live)
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatal("realtime event blocked after the listener stopped")
+	}
+}
@@ -0,0 +1,301 @@
+package services
+
+import (
+	"app/internal/domains"
+	"app/internal/logging"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ExportPool runs ExportPayment on a fixed number of workers per provider so
+// one slow browser flow no longer holds up every other payment or the
+// realtime stream. Payments queue up in a bounded lane for the provider they
+// asked for; when that lane is full the payment is marked busy right away.
+type ExportPool interface {
+	Submit(ctx context.Context, collection string, record domains.RecordHook[domains.PaymentRecord]) error
+	QueueDepth() map[domains.PaymentProvider]int
+	// Pause stops attempts against provider until Resume, whichever lane
+	// the payment came in through: payments fail over past it, and those
+	// only it can take wait for Resume.
+	Pause(provider domains.PaymentProvider) error
+	Resume(provider domains.PaymentProvider) error
+	Paused() []domains.PaymentProvider
+	Start(ctx context.Context)
+	Stop()
+}
+
+type exportJob struct {
+	collection string
+	record     domains.RecordHook[domains.PaymentRecord]
+}
+
+type exportLane struct {
+	jobs    chan exportJob
+	workers int
+}
+
+type exportPool struct {
+	exportService   ExportService
+	status          PaymentStatusService
+	locale          string
+	defaultProvider domains.PaymentProvider
+	lanes           map[domains.PaymentProvider]*exportLane
+	slots           *ProviderSlots
+	queued          sync.Map
+	mu              sync.RWMutex
+	stopped         bool
+}
+
+// NewExportPool creates one lane per provider with queueSize slots and
+// concurrency[provider] workers, falling back to defaultConcurrency.
+// Payments naming an unknown provider go to the lane of defaultProvider.
+// Pausing is delegated to slots, which the export service checks on every
+// attempt.
+func NewExportPool(exportService ExportService, status PaymentStatusService, locale string, providers []domains.PaymentProvider, defaultProvider domains.PaymentProvider, defaultConcurrency int, concurrency map[string]int, queueSize int, slots *ProviderSlots) ExportPool {
+	p := &exportPool{
+		exportService:   exportService,
+		status:          status,
+		locale:          locale,
+		defaultProvider: defaultProvider,
+		lanes:           map[domains.PaymentProvider]*exportLane{},
+		slots:           slots,
+	}
+	for _, provider := range providers {
+		p.lanes[provider] = &exportLane{
+			jobs:    make(chan exportJob, max(queueSize, 0)),
+			workers: providerConcurrency(provider, defaultConcurrency, concurrency),
+		}
+	}
+	return p
+}
+
+func providerConcurrency(provider domains.PaymentProvider, defaultConcurrency int, concurrency map[string]int) int {
+	workers := defaultConcurrency
+	if n, ok := concurrency[string(provider)]; ok {
+		workers = n
+	}
+	return max(workers, 1)
+}
+
+// ProviderSlots caps the payment attempts running against each provider at
+// once and holds the providers an operator paused. Lanes are picked by the
+// provider a payment asked for, so both apply to the provider an attempt
+// actually uses instead.
+type ProviderSlots struct {
+	slots   map[domains.PaymentProvider]chan struct{}
+	mu      sync.Mutex
+	paused  map[domains.PaymentProvider]bool
+	resumed chan struct{}
+}
+
+// NewProviderSlots gives every provider the same limit as its lane.
+func NewProviderSlots(providers []domains.PaymentProvider, defaultConcurrency int, concurrency map[string]int) *ProviderSlots {
+	s := &ProviderSlots{
+		slots:   map[domains.PaymentProvider]chan struct{}{},
+		paused:  map[domains.PaymentProvider]bool{},
+		resumed: make(chan struct{}),
+	}
+	for _, provider := range providers {
+		s.slots[provider] = make(chan struct{}, providerConcurrency(provider, defaultConcurrency, concurrency))
+	}
+	return s
+}
+
+// Acquire waits for a free slot of provider and returns the func that frees
+// it. It fails with domains.ErrProviderPaused while provider is paused.
+// Providers without slots are not limited.
+func (s *ProviderSlots) Acquire(ctx context.Context, provider domains.PaymentProvider) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	slots, ok := s.slots[provider]
+	if !ok {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	// Checked once the slot is held, so a pause that came in while waiting
+	// still applies.
+	if s.isPaused(provider) {
+		<-slots
+		return nil, fmt.Errorf("%w: %s", domains.ErrProviderPaused, provider)
+	}
+	return func() { <-slots }, nil
+}
+
+// Unpaused returns the providers that are not paused, in order, and waits
+// for a Resume while all of them are.
+func (s *ProviderSlots) Unpaused(ctx context.Context, providers []domains.PaymentProvider) ([]domains.PaymentProvider, error) {
+	if s == nil {
+		return providers, nil
+	}
+	for {
+		s.mu.Lock()
+		unpaused := make([]domains.PaymentProvider, 0, len(providers))
+		for _, provider := range providers {
+			if !s.paused[provider] {
+				unpaused = append(unpaused, provider)
+			}
+		}
+		resumed := s.resumed
+		s.mu.Unlock()
+		if len(unpaused) > 0 {
+			return unpaused, nil
+		}
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *ProviderSlots) Pause(provider domains.PaymentProvider) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.slots[provider]; !ok {
+		return fmt.Errorf("payment provider %q is not configured", provider)
+	}
+	s.paused[provider] = true
+	return nil
+}
+
+func (s *ProviderSlots) Resume(provider domains.PaymentProvider) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.slots[provider]; !ok {
+		return fmt.Errorf("payment provider %q is not configured", provider)
+	}
+	if s.paused[provider] {
+		delete(s.paused, provider)
+		close(s.resumed)
+		s.resumed = make(chan struct{})
+	}
+	return nil
+}
+
+func (s *ProviderSlots) Paused() []domains.PaymentProvider {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paused := make([]domains.PaymentProvider, 0, len(s.paused))
+	for provider := range s.paused {
+		paused = append(paused, provider)
+	}
+	sort.Slice(paused, func(i, j int) bool { return paused[i] < paused[j] })
+	return paused
+}
+
+func (s *ProviderSlots) isPaused(provider domains.PaymentProvider) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused[provider]
+}
+
+func (p *exportPool) Start(ctx context.Context) {
+	for provider, lane := range p.lanes {
+		for range lane.workers {
+			go func() {
+				for job := range lane.jobs {
+					p.queued.Delete(job.record.Record.Id)
+					if p.isStopped() || ctx.Err() != nil {
+						// Leave it pending; recovery picks it up on the next start.
+						continue
+					}
+					if err := p.exportService.ExportPayment(ctx, job.collection, job.record); err != nil {
+						logging.Payment(job.record.Record.Id, job.record.Record.UserId, string(provider), "export").Error("failed to export payment", "error", err)
+					}
+				}
+			}()
+		}
+	}
+}
+
+// Stop stops intake. Queued payments are dropped and stay pending for the
+// next recovery run; exports already running are left to finish.
+func (p *exportPool) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return
+	}
+	p.stopped = true
+	for _, lane := range p.lanes {
+		close(lane.jobs)
+	}
+}
+
+func (p *exportPool) Pause(provider domains.PaymentProvider) error {
+	return p.slots.Pause(provider)
+}
+
+func (p *exportPool) Resume(provider domains.PaymentProvider) error {
+	return p.slots.Resume(provider)
+}
+
+func (p *exportPool) Paused() []domains.PaymentProvider {
+	return p.slots.Paused()
+}
+
+func (p *exportPool) isStopped() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.stopped
+}
+
+// Submit queues a newly created payment. Other actions are ignored, as are
+// payments that are already waiting in a lane. When the lane is full
+// domains.ErrBusy is returned and a pending payment is moved to
+// domains.StatusBusy.
+func (p *exportPool) Submit(ctx context.Context, collection string, record domains.RecordHook[domains.PaymentRecord]) error {
+	if record.Action != "create" {
+		return nil
+	}
+	lane, ok := p.lanes[domains.PaymentProvider(record.Record.Provider)]
+	if !ok {
+		lane, ok = p.lanes[p.defaultProvider]
+	}
+	if !ok {
+		return fmt.Errorf("no export lane for provider %q", record.Record.Provider)
+	}
+	if _, queued := p.queued.LoadOrStore(record.Record.Id, struct{}{}); queued {
+		return nil
+	}
+	p.mu.RLock()
+	if p.stopped {
+		p.mu.RUnlock()
+		p.queued.Delete(record.Record.Id)
+		return ErrShuttingDown
+	}
+	select {
+	case lane.jobs <- exportJob{collection: collection, record: record}:
+		p.mu.RUnlock()
+		return nil
+	default:
+	}
+	p.mu.RUnlock()
+	p.queued.Delete(record.Record.Id)
+	if record.Record.Status.Normalize() != domains.StatusPending {
+		// A payment resumed by recovery is past pending and cannot become
+		// busy; it stays as it is for the next recovery run.
+		return fmt.Errorf("payment %s: %w", record.Record.Id, domains.ErrBusy)
+	}
+	if err := p.status.Transition(ctx, collection, record.Record.Id, domains.StatusBusy, domains.UserMessage(domains.ErrBusy, p.locale), map[string]any{"error": domains.ErrBusy.Error(), "progress": 100}); err != nil {
+		return fmt.Errorf("failed to mark payment %s busy: %w", record.Record.Id, err)
+	}
+	return fmt.Errorf("payment %s: %w", record.Record.Id, domains.ErrBusy)
+}
+
+// QueueDepth reports how many payments are waiting in each lane, not
+// counting the ones a worker is already exporting.
+func (p *exportPool) QueueDepth() map[domains.PaymentProvider]int {
+	depth := make(map[domains.PaymentProvider]int, len(p.lanes))
+	for provider, lane := range p.lanes {
+		depth[provider] = len(lane.jobs)
+	}
+	return depth
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"app/internal/domains"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStatus records the statuses payments are moved to.
+type fakeStatus struct {
+	PaymentStatusService
+	mu          sync.Mutex
+	transitions map[string]domains.PaymentStatus
+}
+
+func (s *fakeStatus) Transition(ctx context.Context, collection string, id string, to domains.PaymentStatus, message string, fields map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transitions == nil {
+		s.transitions = map[string]domains.PaymentStatus{}
+	}
+	s.transitions[id] = to
+	return nil
+}
+
+func paymentHook(id string, status domains.PaymentStatus) domains.RecordHook[domains.PaymentRecord] {
+	var record domains.RecordHook[domains.PaymentRecord]
+	record.Action = "create"
+	record.Record.Id = id
+	record.Record.Provider = string(domains.Seagm)
+	record.Record.Status = status
+	return record
+}
+
+func TestExportPoolSubmit(t *testing.T) {
+	status := &fakeStatus{}
+	providers := []domains.PaymentProvider{domains.Seagm}
+	pool := NewExportPool(nil, status, domains.DefaultLocale, providers, domains.Seagm, 1, nil, 1, NewProviderSlots(providers, 1, nil))
+	ctx := context.Background()
+
+	if err := pool.Submit(ctx, "payments", paymentHook("a", domains.StatusPending)); err != nil {
+		t.Fatalf("Submit(a) = %v", err)
+	}
+	if err := pool.Submit(ctx, "payments", paymentHook("a", domains.StatusPending)); err != nil {
+		t.Fatalf("Submit(a) again = %v, want the queued payment ignored", err)
+	}
+	if got := pool.QueueDepth()[domains.Seagm]; got != 1 {
+		t.Fatalf("QueueDepth() = %d, want 1", got)
+	}
+
+	if err := pool.Submit(ctx, "payments", paymentHook("b", domains.StatusPending)); !errors.Is(err, domains.ErrBusy) {
+		t.Fatalf("Submit(b) = %v, want %v", err, domains.ErrBusy)
+	}
+	if got := status.transitions["b"]; got != domains.StatusBusy {
+		t.Fatalf("status of b = %q, want %q", got, domains.StatusBusy)
+	}
+
+	if err := pool.Submit(ctx, "payments", paymentHook("c", domains.StatusSystemPreparing)); !errors.Is(err, domains.ErrBusy) {
+		t.Fatalf("Submit(c) = %v, want %v", err, domains.ErrBusy)
+	}
+	if got, ok := status.transitions["c"]; ok {
+		t.Fatalf("resumed payment c moved to %q, want it left as it is", got)
+	}
+
+	update := paymentHook("d", domains.StatusPending)
+	update.Action = "update"
+	if err := pool.Submit(ctx, "payments", update); err != nil {
+		t.Fatalf("Submit(update) = %v, want it ignored", err)
+	}
+
+	pool.Stop()
+	if err := pool.Submit(ctx, "payments", paymentHook("e", domains.StatusPending)); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("Submit after Stop = %v, want %v", err, ErrShuttingDown)
+	}
+}
+
+func TestProviderSlotsAcquire(t *testing.T) {
+	slots := NewProviderSlots([]domains.PaymentProvider{domains.Seagm}, 1, map[string]int{string(domains.Seagm): 2})
+	ctx := context.Background()
+
+	release1, err := slots.Acquire(ctx, domains.Seagm)
+	if err != nil {
+		t.Fatalf("Acquire() = %v", err)
+	}
+	release2, err := slots.Acquire(ctx, domains.Seagm)
+	if err != nil {
+		t.Fatalf("Acquire() = %v", err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := slots.Acquire(waitCtx, domains.Seagm); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Acquire() over the limit = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		release, err := slots.Acquire(ctx, domains.Seagm)
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	release1()
+	if err := <-acquired; err != nil {
+		t.Fatalf("Acquire() after a release = %v", err)
+	}
+	release2()
+
+	if _, err := slots.Acquire(ctx, domains.LapakGaming); err != nil {
+		t.Fatalf("Acquire() of a provider without slots = %v", err)
+	}
+}
+
+func TestProviderSlotsPause(t *testing.T) {
+	providers := []domains.PaymentProvider{domains.Seagm, domains.Ggkeystore}
+	slots := NewProviderSlots(providers, 1, nil)
+	pool := NewExportPool(nil, &fakeStatus{}, domains.DefaultLocale, providers, domains.Seagm, 1, nil, 1, slots)
+	ctx := context.Background()
+
+	if err := pool.Pause(domains.LapakGaming); err == nil {
+		t.Fatal("Pause() of an unconfigured provider succeeded")
+	}
+	if err := pool.Pause(domains.Seagm); err != nil {
+		t.Fatalf("Pause() = %v", err)
+	}
+	if got := pool.Paused(); len(got) != 1 || got[0] != domains.Seagm {
+		t.Fatalf("Paused() = %v, want [%s]", got, domains.Seagm)
+	}
+
+	if _, err := slots.Acquire(ctx, domains.Seagm); !errors.Is(err, domains.ErrProviderPaused) {
+		t.Fatalf("Acquire() of a paused provider = %v, want %v", err, domains.ErrProviderPaused)
+	}
+	if domains.ClassifyError(domains.ErrProviderPaused) != domains.Retryable {
+		t.Fatal("a paused provider does not fail over")
+	}
+	release, err := slots.Acquire(ctx, domains.Ggkeystore)
+	if err != nil {
+		t.Fatalf("Acquire() of another provider = %v", err)
+	}
+	release()
+
+	unpaused, err := slots.Unpaused(ctx, providers)
+	if err != nil || len(unpaused) != 1 || unpaused[0] != domains.Ggkeystore {
+		t.Fatalf("Unpaused() = %v, %v, want [%s]", unpaused, err, domains.Ggkeystore)
+	}
+
+	if err := pool.Pause(domains.Ggkeystore); err != nil {
+		t.Fatalf("Pause() = %v", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := slots.Unpaused(waitCtx, providers); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Unpaused() with every provider paused = %v, want it to wait", err)
+	}
+
+	done := make(chan []domains.PaymentProvider, 1)
+	go func() {
+		unpaused, _ := slots.Unpaused(ctx, providers)
+		done <- unpaused
+	}()
+	if err := pool.Resume(domains.Seagm); err != nil {
+		t.Fatalf("Resume() = %v", err)
+	}
+	select {
+	case unpaused := <-done:
+		if len(unpaused) != 1 || unpaused[0] != domains.Seagm {
+			t.Fatalf("Unpaused() after Resume = %v, want [%s]", unpaused, domains.Seagm)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Unpaused() still waiting after Resume")
+	}
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"app/internal/domains"
+	"app/internal/repositories"
+	"context"
+	"fmt"
+)
+
+type PaymentStatusService interface {
+	Transition(ctx context.Context, collection string, id string, to domains.PaymentStatus, message string, fields map[string]any) error
+	PrepareTransition(ctx context.Context, collection string, id string, to domains.PaymentStatus, message string, fields map[string]any) (map[string]any, error)
+	Update(ctx context.Context, collection string, id string, fields map[string]any) error
+	Reopen(ctx context.Context, collection string, id string) (domains.PaymentRecord, error)
+}
+
+type paymentStatusService struct {
+	PocketBase repositories.PocketBase
+}
+
+func NewPaymentStatusService(pocketBase repositories.PocketBase) PaymentStatusService {
+	return &paymentStatusService{
+		PocketBase: pocketBase,
+	}
+}
+
+// Transition moves a payment to status to, writing message and any extra
+// fields in the same PATCH. Moves the transition table does not allow are
+// refused with domains.ErrIllegalTransition.
+func (s *paymentStatusService) Transition(ctx context.Context, collection string, id string, to domains.PaymentStatus, message string, fields map[string]any) error {
+	updateData, err := s.PrepareTransition(ctx, collection, id, to, message, fields)
+	if err != nil {
+		return err
+	}
+	return s.PocketBase.UpdateRecord(ctx, collection, id, updateData)
+}
+
+// PrepareTransition validates a transition and returns the PATCH body
+// without writing it, for callers that apply it inside a batch.
+func (s *paymentStatusService) PrepareTransition(ctx context.Context, collection string, id string, to domains.PaymentStatus, message string, fields map[string]any) (map[string]any, error) {
+	current, err := repositories.Get[domains.PaymentRecord](ctx, s.PocketBase, collection, id)
+	if err != nil {
+		return nil, err
+	}
+	if !current.Status.CanTransition(to) {
+		return nil, fmt.Errorf("%w: %s -> %s for payment %s", domains.ErrIllegalTransition, current.Status.Normalize(), to, id)
+	}
+	updateData := map[string]any{}
+	for k, v := range fields {
+		updateData[k] = v
+	}
+	updateData["status"] = to
+	updateData["message"] = message
+	return updateData, nil
+}
+
+// Update writes fields that do not change the status, e.g. progress. It is
+// refused once the payment is finished so a late write cannot regress it.
+func (s *paymentStatusService) Update(ctx context.Context, collection string, id string, fields map[string]any) error {
+	if _, ok := fields["status"]; ok {
+		return fmt.Errorf("%w: status must be changed through Transition", domains.ErrIllegalTransition)
+	}
+	current, err := repositories.Get[domains.PaymentRecord](ctx, s.PocketBase, collection, id)
+	if err != nil {
+		return err
+	}
+	if current.Status.IsFinal() {
+		return fmt.Errorf("%w: payment %s is %s", domains.ErrPaymentFinished, id, current.Status)
+	}
+	return s.PocketBase.UpdateRecord(ctx, collection, id, fields)
+}
+
+// Reopen moves a rejected or busy payment back to pending so it can be
+// exported again. Earlier attempts are kept but marked superseded, and the
+// fields of the previous export are cleared.
+func (s *paymentStatusService) Reopen(ctx context.Context, collection string, id string) (domains.PaymentRecord, error) {
+	current, err := repositories.Get[domains.PaymentRecord](ctx, s.PocketBase, collection, id)
+	if err != nil {
+		return domains.PaymentRecord{}, err
+	}
+	if !current.Status.CanReopen() {
+		return domains.PaymentRecord{}, fmt.Errorf("%w: payment %s is %s and cannot be reopened", domains.ErrIllegalTransition, id, current.Status.Normalize())
+	}
+	attempts := make([]domains.PaymentAttempt, 0, len(current.Attempts))
+	for _, attempt := range current.Attempts {
+		attempt.Superseded = true
+		attempts = append(attempts, attempt)
+	}
+	fields := map[string]any{
+		"status":     domains.StatusPending,
+		"message":    "",
+		"error":      "",
+		"progress":   0,
+		"attempts":   attempts,
+		"orderId":    "",
+		"qrCode":     "",
+		"paymentUrl": "",
+		"expiresAt":  "",
+	}
+	if err := s.PocketBase.UpdateRecord(ctx, collection, id, fields); err != nil {
+		return domains.PaymentRecord{}, err
+	}
+	current.Status = domains.StatusPending
+	current.Progress = 0
+	current.Attempts = attempts
+	current.PaymentUrl = ""
+	current.ExpiresAt = ""
+	return current, nil
+}
@@ -2,57 +2,250 @@ package services
 
 import (
 	"app/internal/domains"
+	"app/internal/logging"
+	"app/internal/metrics"
 	"app/internal/repositories"
-
-	"github.com/shopspring/decimal"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
 )
 
 type VerifyService interface {
-	UpdateOrderStatus(collection string, id string, status string, message string) error
-	AddCredit(userId string, amount decimal.Decimal) error
-	GetPendingPayment() ([]domains.PaymentRecord, error)
-	VerifyByUrl(url string) (bool, error)
+	UpdateOrderStatus(ctx context.Context, collection string, id string, status domains.PaymentStatus, message string) error
+	AddCredit(ctx context.Context, collection string, payment domains.PaymentRecord, message string) error
+	GetPendingPayment(ctx context.Context) ([]domains.PaymentRecord, error)
+	VerifyByUrl(ctx context.Context, url string) (bool, error)
+	VerifyPayment(ctx context.Context, collection string, id string) (domains.PaymentStatus, error)
+	ExpireOverduePayments(ctx context.Context, collection string, ttl time.Duration) error
+	// CheckCreditSetup fails unless PocketBase is set up for AddCredit.
+	CheckCreditSetup(ctx context.Context) error
 }
 
 func NewVerifyService(pocketBase repositories.PocketBase, verifyRepo repositories.VerifyRepository) VerifyService {
 	return &verifyService{
 		PocketBase: pocketBase,
 		VerifyRepo: verifyRepo,
+		Status:     NewPaymentStatusService(pocketBase),
 	}
 }
 
 type verifyService struct {
 	PocketBase repositories.PocketBase
 	VerifyRepo repositories.VerifyRepository
+	Status     PaymentStatusService
+	crediting  sync.Map
+	// verifying holds the ids being verified, so the expiry job never
+	// expires a payment a verification is about to credit.
+	verifying sync.Map
 }
 
-func (s *verifyService) VerifyByUrl(url string) (bool, error) {
-	return s.VerifyRepo.VerifyByUrl(url)
+const creditTransactionsCollection = "creditTransactions"
+
+var ErrAlreadyCredited = errors.New("payment has already been credited")
+
+// expiryGrace is how long after expiresAt a payment is left alone, so a
+// customer who paid at the last moment is credited by the regular verify run.
+const expiryGrace = 2 * time.Minute
+
+// expiryVerifyWindow is how long the expiry job keeps retrying the final
+// verification of an overdue payment whose payment page cannot be checked
+// before it expires it anyway.
+const expiryVerifyWindow = 30 * time.Minute
+
+func (s *verifyService) VerifyByUrl(ctx context.Context, url string) (bool, error) {
+	return s.VerifyRepo.VerifyByUrl(ctx, url)
 }
 
-func (s *verifyService) UpdateOrderStatus(collection string, id string, status string, message string) error {
-	updateData := map[string]any{
-		"status":  status,
-		"message": message,
+// VerifyPayment checks the payment page of a user-paying payment and credits
+// or rejects it accordingly, returning the status it ended up in.
+func (s *verifyService) VerifyPayment(ctx context.Context, collection string, id string) (domains.PaymentStatus, error) {
+	if _, busy := s.verifying.LoadOrStore(id, struct{}{}); busy {
+		return "", fmt.Errorf("payment %s is already being verified", id)
+	}
+	defer s.verifying.Delete(id)
+	payment, err := repositories.Get[domains.PaymentRecord](ctx, s.PocketBase, collection, id)
+	if err != nil {
+		return "", err
+	}
+	if payment.Status != domains.StatusUserPaying || payment.PaymentUrl == "" {
+		return payment.Status, fmt.Errorf("payment %s is %s and has nothing to verify", id, payment.Status.Normalize())
+	}
+	logger := logging.Payment(payment.Id, payment.UserId, payment.Provider, "verify")
+	success, err := s.VerifyByUrl(ctx, payment.PaymentUrl)
+	if err != nil {
+		metrics.Verifications.WithLabelValues(metrics.ResultError).Inc()
+		return payment.Status, err
+	}
+	if success {
+		if err := s.AddCredit(ctx, collection, payment, "Payment verified from system"); err != nil {
+			metrics.Verifications.WithLabelValues(metrics.ResultError).Inc()
+			return payment.Status, err
+		}
+		metrics.Verifications.WithLabelValues(metrics.ResultSuccess).Inc()
+		logger.Info("payment verified and credited", "amount", payment.Amount)
+		return domains.StatusSuccess, nil
 	}
-	return s.PocketBase.UpdateRecord(collection, id, updateData)
+	if err := s.UpdateOrderStatus(ctx, collection, id, domains.StatusReject, "Payment verification failed"); err != nil {
+		metrics.Verifications.WithLabelValues(metrics.ResultError).Inc()
+		return payment.Status, err
+	}
+	metrics.Verifications.WithLabelValues(metrics.ResultReject).Inc()
+	logger.Info("payment verification failed, rejected")
+	return domains.StatusReject, nil
+}
+
+func (s *verifyService) UpdateOrderStatus(ctx context.Context, collection string, id string, status domains.PaymentStatus, message string) error {
+	return s.Status.Transition(ctx, collection, id, status, message, nil)
 }
 
-func (s *verifyService) AddCredit(userId string, amount decimal.Decimal) error {
+// AddCredit marks payment as successful and credits the user in one
+// PocketBase batch, so neither happens without the other. A payment that
+// already has a credit transaction is refused with ErrAlreadyCredited; a
+// unique index on creditTransactions.paymentId keeps that true across
+// replicas, because the whole batch is rolled back when the insert fails.
+func (s *verifyService) AddCredit(ctx context.Context, collection string, payment domains.PaymentRecord, message string) error {
+	if _, busy := s.crediting.LoadOrStore(payment.Id, struct{}{}); busy {
+		return fmt.Errorf("%w: payment %s is being credited", ErrAlreadyCredited, payment.Id)
+	}
+	defer s.crediting.Delete(payment.Id)
+
+	existing, err := repositories.List[domains.CreditTransactionRecord](ctx, s.PocketBase, creditTransactionsCollection, repositories.Query{Filter: repositories.Eq("paymentId", payment.Id)})
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("%w: payment %s has transaction %s", ErrAlreadyCredited, payment.Id, existing[0].Id)
+	}
+
+	updateData, err := s.Status.PrepareTransition(ctx, collection, payment.Id, domains.StatusSuccess, message, nil)
+	if err != nil {
+		return err
+	}
 	createData := map[string]any{
-		"userId":      userId,
-		"amount":      amount,
+		"userId":      payment.UserId,
+		"paymentId":   payment.Id,
+		"amount":      payment.Amount,
 		"description": "Deposit from payment",
 		"type":        "ADD",
 	}
-	_, err := s.PocketBase.CreateRecord("creditTransactions", createData)
+	_, err = s.PocketBase.Batch(ctx, []domains.BatchRequest{
+		{Method: http.MethodPatch, Url: "/api/collections/" + collection + "/records/" + payment.Id, Body: updateData},
+		{Method: http.MethodPost, Url: "/api/collections/" + creditTransactionsCollection + "/records", Body: createData},
+	})
 	return err
 }
 
-func (s *verifyService) GetPendingPayment() ([]domains.PaymentRecord, error) {
-	records, err := s.PocketBase.GetPaymentRecordByFilter("payment", "status='user-paying' && paymentUrl != ''")
+// CheckCreditSetup checks the two PocketBase settings AddCredit relies on:
+// batch requests must be enabled, and creditTransactions needs a unique
+// index on paymentId so a payment cannot be credited twice.
+func (s *verifyService) CheckCreditSetup(ctx context.Context) error {
+	enabled, err := s.PocketBase.BatchEnabled(ctx)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to read PocketBase settings: %w", err)
+	}
+	if !enabled {
+		return errors.New("PocketBase batch requests are disabled; enable them under Settings > Application")
+	}
+	indexes, err := s.PocketBase.Indexes(ctx, creditTransactionsCollection)
+	if err != nil {
+		return fmt.Errorf("failed to read %s indexes: %w", creditTransactionsCollection, err)
+	}
+	for _, index := range indexes {
+		if uniquePaymentIdIndex.MatchString(index) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s has no unique index on paymentId", creditTransactionsCollection)
+}
+
+// uniquePaymentIdIndex matches a unique index on paymentId alone as
+// PocketBase stores it, e.g.
+// CREATE UNIQUE INDEX `idx_paymentId` ON `creditTransactions` (`paymentId`).
+var uniquePaymentIdIndex = regexp.MustCompile("(?i)^CREATE UNIQUE INDEX .*\\(\\s*`?paymentId`?\\s*\\)\\s*$")
+
+// ExpireOverduePayments moves unpaid payments more than expiryGrace past
+// their expiresAt to expired and closes the provider tab still held for
+// them. Payments exported before expiresAt existed fall back to created plus
+// ttl. Each payment is verified one last time first and credited instead if
+// it was paid; payments a verification is already handling are skipped.
+func (s *verifyService) ExpireOverduePayments(ctx context.Context, collection string, ttl time.Duration) error {
+	now := time.Now()
+	filter := repositories.And(
+		repositories.Eq("status", domains.StatusUserPaying),
+		repositories.Or(
+			repositories.And(repositories.Neq("expiresAt", ""), repositories.Lt("expiresAt", now.Add(-expiryGrace))),
+			repositories.And(repositories.Eq("expiresAt", ""), repositories.Lt("created", now.Add(-ttl-expiryGrace))),
+		),
+	)
+	records, err := repositories.List[domains.PaymentRecord](ctx, s.PocketBase, collection, repositories.Query{Filter: filter})
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		logger := logging.Payment(record.Id, record.UserId, record.Provider, "expiry")
+		if _, busy := s.verifying.LoadOrStore(record.Id, struct{}{}); busy {
+			logger.Info("payment is being verified, not expiring it")
+			continue
+		}
+		s.expire(ctx, collection, record, overdueSince(record, ttl), logger)
+		s.verifying.Delete(record.Id)
+	}
+	return nil
+}
+
+// expire runs the final verification of an overdue payment and expires it
+// unless it turns out to be paid.
+func (s *verifyService) expire(ctx context.Context, collection string, record domains.PaymentRecord, overdue time.Time, logger *slog.Logger) {
+	if record.PaymentUrl != "" {
+		paid, err := s.VerifyByUrl(ctx, record.PaymentUrl)
+		switch {
+		case err != nil && time.Since(overdue) < expiryVerifyWindow:
+			logger.Warn("final verification failed, retrying on the next run", "error", err)
+			return
+		case err != nil:
+			logger.Warn("final verification failed, expiring unverified", "error", err)
+		case paid:
+			if err := s.AddCredit(ctx, collection, record, "Payment verified before expiry"); err != nil {
+				logger.Error("failed to credit payment paid before expiry", "error", err)
+				return
+			}
+			metrics.Verifications.WithLabelValues(metrics.ResultSuccess).Inc()
+			logger.Info("payment paid before expiry, credited", "amount", record.Amount)
+			repositories.CloseSession(record.Id)
+			return
+		}
+	}
+	repositories.CloseSession(record.Id)
+	if err := s.Status.Transition(ctx, collection, record.Id, domains.StatusExpired, "Payment expired before it was paid", nil); err != nil {
+		logger.Error("failed to expire payment", "error", err)
+		return
+	}
+	logger.Info("payment expired")
+}
+
+// overdueSince returns when record became due for expiry.
+func overdueSince(record domains.PaymentRecord, ttl time.Duration) time.Time {
+	if expiresAt, err := time.Parse(repositories.DateTimeLayout, record.ExpiresAt); err == nil {
+		return expiresAt
+	}
+	if created, err := time.Parse(repositories.DateTimeLayout, record.Created); err == nil {
+		return created.Add(ttl)
+	}
+	return time.Now()
+}
+
+func (s *verifyService) GetPendingPayment(ctx context.Context) ([]domains.PaymentRecord, error) {
+	records := []domains.PaymentRecord{}
+	for record, err := range repositories.Iterate[domains.PaymentRecord](ctx, s.PocketBase, "payment", repositories.Query{Filter: repositories.And(repositories.Eq("status", domains.StatusUserPaying), repositories.Neq("paymentUrl", ""))}) {
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
 	}
 	return records, nil
 }